@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"transport-realtime/internal/transit"
+)
+
+// /busroutepattern のVercelの関数
+// 処理はローカルサーバーと共有するinternal/transitのハンドラーに任せる
+var busroutePatternHandler = transit.LoggingMiddleware(transit.CORSMiddleware(transit.GetBusroutePattern))
+
+func init() {
+	transit.SetupLogging()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	busroutePatternHandler(w, r)
+}
@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"transport-realtime/internal/transit"
+)
+
+// /busstop のVercelの関数
+// 処理はローカルサーバーと共有するinternal/transitのハンドラーに任せる
+var busstopHandler = transit.LoggingMiddleware(transit.CORSMiddleware(transit.GetBusstop))
+
+func init() {
+	transit.SetupLogging()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	busstopHandler(w, r)
+}
@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"transport-realtime/internal/transit"
+)
+
+// /busstoppole/{sameAs}/departures のVercelの関数 (sameAsはrewritesでクエリパラメータに渡す)
+// 処理はローカルサーバーと共有するinternal/transitのハンドラーに任せる
+var busstopPoleDeparturesHandler = transit.LoggingMiddleware(transit.CORSMiddleware(transit.GetBusstopPoleDepartures))
+
+func init() {
+	transit.SetupLogging()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	busstopPoleDeparturesHandler(w, r)
+}
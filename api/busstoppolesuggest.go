@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"transport-realtime/internal/transit"
+)
+
+// /busstoppole/suggest のVercelの関数
+// 処理はローカルサーバーと共有するinternal/transitのハンドラーに任せる
+var busstopPoleSuggestHandler = transit.LoggingMiddleware(transit.CORSMiddleware(transit.GetBusstopPoleSuggestions))
+
+func init() {
+	transit.SetupLogging()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	busstopPoleSuggestHandler(w, r)
+}
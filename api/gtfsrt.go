@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"transport-realtime/internal/transit"
+)
+
+// /gtfsrt/vehiclepositions のVercelの関数
+// 処理はローカルサーバーと共有するinternal/transitのハンドラーに任せる
+var gtfsRealtimeHandler = transit.LoggingMiddleware(transit.CORSMiddleware(transit.GetGTFSRealtimeVehiclePositions))
+
+func init() {
+	transit.SetupLogging()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	gtfsRealtimeHandler(w, r)
+}
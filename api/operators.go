@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"transport-realtime/internal/transit"
+)
+
+// /operators のVercelの関数
+// 処理はローカルサーバーと共有するinternal/transitのハンドラーに任せる
+var operatorsHandler = transit.LoggingMiddleware(transit.CORSMiddleware(transit.GetOperators))
+
+func init() {
+	transit.SetupLogging()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	operatorsHandler(w, r)
+}
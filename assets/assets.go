@@ -0,0 +1,11 @@
+// Package assets はODPTの静的データファイル (odpt_<型>_<assetName>.json) を置くディレクトリです。
+// ファイルはビルド時にバイナリへ埋め込まれ、Vercelの関数もローカルサーバーも同じデータを使います。
+package assets
+
+import "embed"
+
+// 事業者の登録情報 (operators.json) と事業者ごとのデータファイル
+// versionsディレクトリの古い版と、大きい時刻表を置くtimetablesディレクトリは埋め込まない
+//
+//go:embed *.json
+var FS embed.FS
@@ -0,0 +1,33 @@
+// fakeodpt ODPT APIの代わりに記録済みのデータを返すローカルサーバー
+//
+// fixturesディレクトリの odpt_<型>_<事業者>.json (例: odpt_Bus_Toei.json) を読み込み、
+// /odpt:<型> へのリクエストにODPT APIと同じクエリのフィルタを適用して返します。
+//
+//	go run ./cmd/fakeodpt -addr :9000 -fixtures testdata/odpt
+//	ODPT_API_BASE_URL=http://localhost:9000 go run .
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"transport-realtime/internal/fakeodpt"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "待ち受けるアドレス")
+	dir := flag.String("fixtures", "testdata/odpt", "odpt_<型>_<事業者>.json を置いたディレクトリ")
+	rebase := flag.Bool("rebase-time", true, "odpt:Busの日時を、最新のdc:dateがリクエスト時刻になるようずらす")
+	flag.Parse()
+
+	store, err := fakeodpt.LoadFixtures(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.Handle("/", store.Handler(*rebase))
+
+	log.Printf("Starting fake ODPT server on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
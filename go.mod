@@ -2,7 +2,10 @@ module transport-realtime
 
 go 1.21
 
-require github.com/stretchr/testify v1.11.1
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/stretchr/testify v1.11.1
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
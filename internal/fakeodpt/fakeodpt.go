@@ -0,0 +1,164 @@
+// Package fakeodpt ODPT APIの代わりに記録済みのデータを返すサーバーの実装
+//
+// fixturesディレクトリの odpt_<型>_<事業者>.json (例: odpt_Bus_Toei.json) を読み込み、
+// /odpt:<型> へのリクエストにODPT APIと同じクエリのフィルタを適用して返す。
+// cmd/fakeodpt のほか、ODPT APIを使う処理のテストから使う
+package fakeodpt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 記録時刻を現在時刻にずらす車両データの日時フィールド
+var busTimeFields = []string{"dc:date", "dct:valid", "odpt:fromBusstopPoleTime"}
+
+// Store 型ごとの記録済みデータ
+type Store struct {
+	records map[string][]map[string]interface{} // 型 (Bus, BusstopPole...) ごとのレコード
+}
+
+// ディレクトリ内の odpt_<型>_<事業者>.json をすべて読み込む
+func LoadFixtures(dir string) (*Store, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "odpt_*_*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no fixtures found in %s", dir)
+	}
+
+	store := &Store{records: make(map[string][]map[string]interface{})}
+	for _, path := range paths {
+		dataType := strings.SplitN(strings.TrimPrefix(filepath.Base(path), "odpt_"), "_", 2)[0]
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var records []map[string]interface{}
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		store.records[dataType] = append(store.records[dataType], records...)
+		log.Printf("Loaded %d %s records from %s", len(records), dataType, path)
+	}
+	return store, nil
+}
+
+// /odpt:<型> (ベースURLにパスが含まれていてもよい) へのリクエストに答えるハンドラーを返す
+// rebaseがtrueの場合、odpt:Busの日時を最新のdc:dateがリクエスト時刻になるようずらす
+func (s *Store) Handler(rebase bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, rebase)
+	})
+}
+
+func (s *Store) serve(w http.ResponseWriter, r *http.Request, rebase bool) {
+	i := strings.LastIndex(r.URL.Path, "/odpt:")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	dataType := strings.TrimSuffix(r.URL.Path[i+len("/odpt:"):], ".json")
+
+	records, ok := s.records[dataType]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	result := make([]map[string]interface{}, 0)
+	for _, record := range records {
+		if matchesQuery(record, r.URL.Query()) {
+			result = append(result, record)
+		}
+	}
+	if rebase && dataType == "Bus" {
+		result = rebaseBusTimes(result, time.Now())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		return
+	}
+	log.Printf("Returned %d %s records for %s", len(result), dataType, r.URL.RawQuery)
+}
+
+// ODPT APIと同様に、クエリの各パラメータと同じ名前のフィールドが一致するレコードに絞り込む
+// 配列のフィールド (バス停のodpt:operatorなど) はいずれかの要素が一致すればよい
+func matchesQuery(record map[string]interface{}, query map[string][]string) bool {
+	for key, values := range query {
+		if key == "acl:consumerKey" {
+			continue
+		}
+		for _, value := range values {
+			if !fieldMatches(record[key], value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func fieldMatches(field interface{}, value string) bool {
+	switch v := field.(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	case float64, bool:
+		return fmt.Sprint(v) == value
+	}
+	return false
+}
+
+// 記録済みの車両データの日時を、最新のdc:dateがnowになるようずらす
+func rebaseBusTimes(records []map[string]interface{}, now time.Time) []map[string]interface{} {
+	var latest time.Time
+	for _, record := range records {
+		if t, ok := parseTimeField(record, "dc:date"); ok && t.After(latest) {
+			latest = t
+		}
+	}
+	if latest.IsZero() {
+		return records
+	}
+	offset := now.Sub(latest)
+
+	rebased := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		copied := make(map[string]interface{}, len(record))
+		for key, value := range record {
+			copied[key] = value
+		}
+		for _, field := range busTimeFields {
+			if t, ok := parseTimeField(record, field); ok {
+				copied[field] = t.Add(offset).In(t.Location()).Format(time.RFC3339)
+			}
+		}
+		rebased = append(rebased, copied)
+	}
+	return rebased
+}
+
+func parseTimeField(record map[string]interface{}, field string) (time.Time, bool) {
+	value, ok := record[field].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
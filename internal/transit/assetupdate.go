@@ -0,0 +1,526 @@
+package transit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 書き出した静的データを版ごとに残すディレクトリ (assetsディレクトリ内)
+const assetVersionsDir = "versions"
+
+// 差分の表示でバス停ごとに列挙する最大件数。超えた分は件数のみ表示する
+const maxReportedChanges = 20
+
+// 検証の警告で例として表示する最大件数
+const maxReportedExamples = 3
+
+// assetDataset ODPT APIから取得した1事業者・1型分の静的データ
+type assetDataset struct {
+	dataType string
+	operator *Operator
+	records  []json.RawMessage // 書き出すレコード (ODPT APIの応答のまま)
+	sameAs   []string          // recordsと同じ順のowl:sameAs
+	version  time.Time         // レコードのdc:dateのうち最も新しいもの
+
+	busstops       []ODPTBusstopPole          // dataTypeがBusstopPoleの場合
+	patterns       []ODPTBusroutePattern      // dataTypeがBusroutePatternの場合
+	poleTimetables []ODPTBusstopPoleTimetable // dataTypeがBusstopPoleTimetableの場合
+
+	errors   []string // 書き出しを止める問題
+	warnings []string // 書き出すが報告する問題
+}
+
+func (d *assetDataset) errorf(format string, args ...interface{}) {
+	d.errors = append(d.errors, fmt.Sprintf(format, args...))
+}
+
+// 同じ種類の問題をまとめ、件数と例を警告にする
+func (d *assetDataset) warnExamples(message string, examples []string) {
+	if len(examples) == 0 {
+		return
+	}
+	shown := examples
+	if len(shown) > maxReportedExamples {
+		shown = shown[:maxReportedExamples]
+	}
+	d.warnings = append(d.warnings, fmt.Sprintf("%d %s (e.g. %s)", len(examples), message, strings.Join(shown, ", ")))
+}
+
+// update-assetsサブコマンド: ODPT APIから静的データを取得・検証し、assetsディレクトリを更新する
+func RunAssetUpdate(args []string) error {
+	defaultDir := os.Getenv("ASSETS_DIR")
+	if defaultDir == "" {
+		defaultDir = "assets"
+	}
+
+	flags := flag.NewFlagSet("update-assets", flag.ContinueOnError)
+	operatorFlag := flags.String("operator", "", "事業者のID (カンマ区切りで複数指定可, 省略時は登録されているすべての事業者)")
+	dir := flags.String("dir", defaultDir, "書き出すassetsディレクトリ")
+	typesFlag := flags.String("types", strings.Join(datasetTypes, ","), "取得するデータの型 (カンマ区切り)")
+	moveThreshold := flags.Float64("move-threshold", 10, "移動したとみなすバス停の距離 (m)")
+	timeout := flags.Duration("timeout", 5*time.Minute, "1回のODPT APIへのリクエストのタイムアウト")
+	dryRun := flags.Bool("dry-run", false, "検証と差分の表示のみ行い、ファイルを書き出さない")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var operatorIDs []string
+	if *operatorFlag == "" {
+		for _, operator := range operators() {
+			operatorIDs = append(operatorIDs, operator.ID)
+		}
+	} else {
+		var err error
+		if operatorIDs, err = parseOperators(*operatorFlag); err != nil {
+			return err
+		}
+	}
+
+	var types []string
+	for _, dataType := range strings.Split(*typesFlag, ",") {
+		dataType = strings.TrimSpace(dataType)
+		if !isDatasetType(dataType) {
+			return fmt.Errorf("invalid data type: %s", dataType)
+		}
+		types = append(types, dataType)
+	}
+
+	// 静的データは大きいため、車両情報より長いタイムアウトで取得する
+	client := &http.Client{Timeout: *timeout}
+	ctx := context.Background()
+
+	failed := 0
+	for _, operatorID := range operatorIDs {
+		operator := lookupOperator(operatorID)
+		if err := updateOperatorAssets(ctx, client, operator, types, *dir, *moveThreshold, *dryRun, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stdout, "%s: %v\n", operator.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to update assets for %d of %d operators", failed, len(operatorIDs))
+	}
+	return nil
+}
+
+func isDatasetType(dataType string) bool {
+	for _, t := range datasetTypes {
+		if t == dataType {
+			return true
+		}
+	}
+	return false
+}
+
+// 1事業者の静的データをすべて取得・検証してから書き出す
+// 型の間で版が食い違わないよう、1つでも問題があればその事業者のファイルは1つも書き出さない
+func updateOperatorAssets(ctx context.Context, client *http.Client, operator *Operator, types []string, dir string, moveThreshold float64, dryRun bool, out io.Writer) error {
+	datasets := make(map[string]*assetDataset, len(types))
+	for _, dataType := range types {
+		dataset, err := fetchAssetDataset(ctx, client, dataType, operator)
+		if err != nil {
+			return fmt.Errorf("fetching %s: %w", dataType, err)
+		}
+		datasets[dataType] = dataset
+	}
+
+	// 系統の停留所の順序に出てくるバス停が、同時に取得したバス停データにあるか確認する
+	if busstops, patterns := datasets["BusstopPole"], datasets["BusroutePattern"]; busstops != nil && patterns != nil {
+		known := make(map[string]bool, len(busstops.busstops))
+		for _, busstop := range busstops.busstops {
+			known[busstop.SameAs] = true
+		}
+		var missing []string
+		for _, pattern := range patterns.patterns {
+			for _, item := range pattern.BusstopPoleOrder {
+				if !known[item.BusstopPole] {
+					missing = append(missing, item.BusstopPole)
+				}
+			}
+		}
+		patterns.warnExamples("busstopPoleOrder entries refer to unknown busstop poles", missing)
+	}
+
+	// 標柱時刻表の標柱が、同時に取得したバス停データにあるか確認する
+	if busstops, timetables := datasets["BusstopPole"], datasets["BusstopPoleTimetable"]; busstops != nil && timetables != nil {
+		known := make(map[string]bool, len(busstops.busstops))
+		for _, busstop := range busstops.busstops {
+			known[busstop.SameAs] = true
+		}
+		var missing []string
+		for _, timetable := range timetables.poleTimetables {
+			if !known[timetable.BusstopPole] {
+				missing = append(missing, timetable.BusstopPole)
+			}
+		}
+		timetables.warnExamples("busstop pole timetables refer to unknown busstop poles", missing)
+	}
+
+	valid := true
+	for _, dataType := range types {
+		dataset := datasets[dataType]
+		path := filepath.Join(dir, filepath.FromSlash(assetPath(dataType, operator)))
+
+		fmt.Fprintf(out, "%s %s: %d records, version %s\n", operator.ID, dataType, len(dataset.records), dataset.version.Format(time.RFC3339))
+		if err := reportAssetChanges(out, dataset, path, moveThreshold); err != nil {
+			return fmt.Errorf("comparing with %s: %w", path, err)
+		}
+		for _, warning := range dataset.warnings {
+			fmt.Fprintf(out, "  warning: %s\n", warning)
+		}
+		for _, e := range dataset.errors {
+			fmt.Fprintf(out, "  error: %s\n", e)
+		}
+		if len(dataset.errors) > 0 {
+			valid = false
+		}
+	}
+
+	if !valid {
+		return errors.New("validation failed, assets were not updated")
+	}
+	if dryRun {
+		return nil
+	}
+
+	for _, dataType := range types {
+		written, err := writeAssetDataset(dir, datasets[dataType])
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", dataType, err)
+		}
+		fmt.Fprintf(out, "  wrote %s\n", written)
+	}
+	return nil
+}
+
+// ODPT APIのデータダンプ (odpt:<型>.json) から事業者のデータを取得し、型の構造体で検証する
+func fetchAssetDataset(ctx context.Context, client *http.Client, dataType string, operator *Operator) (*assetDataset, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/odpt:%s.json", odptAPIBaseURL, dataType), nil)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Add("odpt:operator", operator.ID)
+	if consumerKey := odptConsumerKey(); consumerKey != "" {
+		q.Add("acl:consumerKey", consumerKey)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		logUpstreamRequest(ctx, req.URL, operator.ID, 0, time.Since(start), 0, err)
+		return nil, redactError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logUpstreamRequest(ctx, req.URL, operator.ID, resp.StatusCode, time.Since(start), 0, nil)
+		return nil, fmt.Errorf("ODPT API returned status: %d", resp.StatusCode)
+	}
+
+	var raw []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		logUpstreamRequest(ctx, req.URL, operator.ID, resp.StatusCode, time.Since(start), 0, err)
+		return nil, fmt.Errorf("parsing response: %w", err)
+	}
+	logUpstreamRequest(ctx, req.URL, operator.ID, resp.StatusCode, time.Since(start), len(raw), nil)
+
+	return validateAssetRecords(dataType, operator, raw), nil
+}
+
+// レコードを型の構造体にパースして検証する
+// データダンプは全事業者分を返す場合があるため、ほかの事業者のレコードはここで除く
+func validateAssetRecords(dataType string, operator *Operator, raw []json.RawMessage) *assetDataset {
+	dataset := &assetDataset{dataType: dataType, operator: operator}
+	seen := make(map[string]bool, len(raw))
+	prefix := "odpt." + dataType + ":"
+
+	var noCoordinates, noTitle, badTimes []string
+	for i, record := range raw {
+		var common struct {
+			ID     string `json:"@id"`
+			SameAs string `json:"owl:sameAs"`
+			Date   string `json:"dc:date"`
+		}
+		if err := json.Unmarshal(record, &common); err != nil {
+			dataset.errorf("record %d: %v", i, err)
+			continue
+		}
+
+		var busstop ODPTBusstopPole
+		var pattern ODPTBusroutePattern
+		var poleTimetable ODPTBusstopPoleTimetable
+		switch dataType {
+		case "BusstopPole":
+			if err := json.Unmarshal(record, &busstop); err != nil {
+				dataset.errorf("%s: %v", common.SameAs, err)
+				continue
+			}
+			if !containsString(busstop.Operator, operator.ID) {
+				continue
+			}
+			if busstop.Lat == 0 && busstop.Long == 0 {
+				noCoordinates = append(noCoordinates, busstop.SameAs)
+			} else if busstop.Lat < -90 || busstop.Lat > 90 || busstop.Long < -180 || busstop.Long > 180 {
+				dataset.errorf("%s: coordinates out of range (%f, %f)", busstop.SameAs, busstop.Lat, busstop.Long)
+			}
+			if busstopTitle(busstop) == "" {
+				noTitle = append(noTitle, busstop.SameAs)
+			}
+
+		case "BusroutePattern":
+			if err := json.Unmarshal(record, &pattern); err != nil {
+				dataset.errorf("%s: %v", common.SameAs, err)
+				continue
+			}
+			if pattern.Operator != operator.ID {
+				continue
+			}
+			if len(pattern.BusstopPoleOrder) == 0 {
+				dataset.errorf("%s: empty odpt:busstopPoleOrder", pattern.SameAs)
+			}
+			for j := 1; j < len(pattern.BusstopPoleOrder); j++ {
+				if pattern.BusstopPoleOrder[j].Index <= pattern.BusstopPoleOrder[j-1].Index {
+					dataset.errorf("%s: odpt:busstopPoleOrder is not in index order", pattern.SameAs)
+					break
+				}
+			}
+
+		case "BusTimetable":
+			var timetable ODPTBusTimetable
+			if err := json.Unmarshal(record, &timetable); err != nil {
+				dataset.errorf("%s: %v", common.SameAs, err)
+				continue
+			}
+			if timetable.Operator != operator.ID {
+				continue
+			}
+			if len(timetable.BusTimetableObject) == 0 {
+				dataset.errorf("%s: empty odpt:busTimetableObject", timetable.SameAs)
+			}
+			for _, item := range timetable.BusTimetableObject {
+				for _, value := range []string{item.ArrivalTime, item.DepartureTime} {
+					if _, err := time.Parse("15:04", value); value != "" && err != nil {
+						badTimes = append(badTimes, fmt.Sprintf("%s %q", timetable.SameAs, value))
+					}
+				}
+			}
+
+		case "BusstopPoleTimetable":
+			if err := json.Unmarshal(record, &poleTimetable); err != nil {
+				dataset.errorf("%s: %v", common.SameAs, err)
+				continue
+			}
+			if poleTimetable.Operator != operator.ID {
+				continue
+			}
+			if poleTimetable.BusstopPole == "" {
+				dataset.errorf("%s: empty odpt:busstopPole", poleTimetable.SameAs)
+			}
+			for _, item := range poleTimetable.BusstopPoleTimetableObject {
+				for _, value := range []string{item.ArrivalTime, item.DepartureTime} {
+					if _, err := time.Parse("15:04", value); value != "" && err != nil {
+						badTimes = append(badTimes, fmt.Sprintf("%s %q", poleTimetable.SameAs, value))
+					}
+				}
+			}
+		}
+
+		if common.SameAs == "" || !strings.HasPrefix(common.SameAs, prefix) {
+			dataset.errorf("record %d (%s): invalid owl:sameAs %q", i, common.ID, common.SameAs)
+			continue
+		}
+		if seen[common.SameAs] {
+			dataset.errorf("duplicate owl:sameAs %s", common.SameAs)
+			continue
+		}
+		seen[common.SameAs] = true
+
+		if date, err := time.Parse(time.RFC3339, common.Date); err == nil && date.After(dataset.version) {
+			dataset.version = date
+		}
+		dataset.records = append(dataset.records, record)
+		dataset.sameAs = append(dataset.sameAs, common.SameAs)
+		switch dataType {
+		case "BusstopPole":
+			dataset.busstops = append(dataset.busstops, busstop)
+		case "BusroutePattern":
+			dataset.patterns = append(dataset.patterns, pattern)
+		case "BusstopPoleTimetable":
+			dataset.poleTimetables = append(dataset.poleTimetables, poleTimetable)
+		}
+	}
+
+	if len(dataset.records) == 0 {
+		// 取得に失敗して空のデータで既存のファイルを消さないようにする
+		dataset.errorf("no records for %s", operator.ID)
+	}
+	if dataset.version.IsZero() {
+		dataset.version = time.Now()
+	}
+	dataset.warnExamples("busstop poles have no coordinates", noCoordinates)
+	dataset.warnExamples("busstop poles have no title", noTitle)
+	if len(badTimes) > 0 {
+		dataset.errorf("%d invalid times in odpt:%sObject (e.g. %s)", len(badTimes), strings.ToLower(dataType[:1])+dataType[1:], badTimes[0])
+	}
+	return dataset
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// 現在のファイルと比べて追加・削除されたレコードを表示する
+// バス停は座標がmoveThreshold (m) 以上変わったものを移動として表示する
+func reportAssetChanges(out io.Writer, dataset *assetDataset, path string, moveThreshold float64) error {
+	current, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(out, "  new file (no current data)\n")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var currentRecords []struct {
+		SameAs string  `json:"owl:sameAs"`
+		Lat    float64 `json:"geo:lat"`
+		Long   float64 `json:"geo:long"`
+	}
+	if err := json.Unmarshal(current, &currentRecords); err != nil {
+		return err
+	}
+
+	// 現在のファイルの座標 [緯度, 経度]
+	previous := make(map[string][2]float64, len(currentRecords))
+	for _, record := range currentRecords {
+		previous[record.SameAs] = [2]float64{record.Lat, record.Long}
+	}
+
+	titles := make(map[string]string, len(dataset.busstops))
+	for _, busstop := range dataset.busstops {
+		titles[busstop.SameAs] = busstopTitle(busstop)
+	}
+
+	var added, removed, moved []string
+	next := make(map[string]bool, len(dataset.sameAs))
+	for _, sameAs := range dataset.sameAs {
+		next[sameAs] = true
+		if _, ok := previous[sameAs]; !ok {
+			added = append(added, strings.TrimSpace("+ "+sameAs+" "+titles[sameAs]))
+		}
+	}
+	for _, busstop := range dataset.busstops {
+		position, ok := previous[busstop.SameAs]
+		if !ok {
+			continue
+		}
+		if position == [2]float64{} || (busstop.Lat == 0 && busstop.Long == 0) {
+			continue
+		}
+		if distance := haversineDistance(position[0], position[1], busstop.Lat, busstop.Long); distance >= moveThreshold {
+			moved = append(moved, fmt.Sprintf("~ %s %s moved %.1fm", busstop.SameAs, titles[busstop.SameAs], math.Round(distance*10)/10))
+		}
+	}
+	for sameAs := range previous {
+		if !next[sameAs] {
+			removed = append(removed, "- "+sameAs)
+		}
+	}
+	sort.Strings(removed)
+
+	if dataset.dataType == "BusstopPole" {
+		fmt.Fprintf(out, "  added %d, removed %d, moved %d (>= %gm)\n", len(added), len(removed), len(moved), moveThreshold)
+	} else {
+		fmt.Fprintf(out, "  added %d, removed %d\n", len(added), len(removed))
+	}
+	for _, changes := range [][]string{added, removed, moved} {
+		for i, change := range changes {
+			if i == maxReportedChanges {
+				fmt.Fprintf(out, "    ... and %d more\n", len(changes)-maxReportedChanges)
+				break
+			}
+			fmt.Fprintf(out, "    %s\n", change)
+		}
+	}
+	return nil
+}
+
+// 版ごとのファイル (versions/odpt_<型>_<assetName>_<版>.json) を書き出してから、
+// 読み込まれるファイル (odpt_<型>_<assetName>.json、時刻表はtimetables/odpt_<型>_<assetName>.json) を置き換える
+// どちらも一時ファイルからのrenameで置き換えるため、読み込み中のサーバーが途中までのファイルを読むことはない
+func writeAssetDataset(dir string, dataset *assetDataset) (string, error) {
+	data, err := json.Marshal(dataset.records)
+	if err != nil {
+		return "", err
+	}
+	data = append(data, '\n')
+
+	fileName := assetFileName(dataset.dataType, dataset.operator)
+	versionName := fmt.Sprintf("%s_%s.json", strings.TrimSuffix(fileName, ".json"), dataset.version.Format("20060102T150405"))
+	versionPath := filepath.Join(dir, assetVersionsDir, versionName)
+	if err := os.MkdirAll(filepath.Dir(versionPath), 0o755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(versionPath, data); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(assetPath(dataset.dataType, dataset.operator)))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s (%s)", path, versionPath), nil
+}
+
+// 同じディレクトリの一時ファイルに書き込んでからrenameで置き換える
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,131 @@
+package transit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"transport-realtime/internal/fakeodpt"
+)
+
+func testAssetPole(name string, lat, long float64) map[string]interface{} {
+	return map[string]interface{}{
+		"owl:sameAs":    "odpt.BusstopPole:Toei." + name,
+		"dc:title":      name,
+		"dc:date":       "2025-12-01T03:00:00+09:00",
+		"geo:lat":       lat,
+		"geo:long":      long,
+		"odpt:operator": []string{testOperator},
+	}
+}
+
+func testAssetPattern(poles ...string) map[string]interface{} {
+	order := []map[string]interface{}{}
+	for i, pole := range poles {
+		order = append(order, map[string]interface{}{"odpt:index": i + 1, "odpt:busstopPole": "odpt.BusstopPole:Toei." + pole})
+	}
+	return map[string]interface{}{
+		"owl:sameAs":            "odpt.BusroutePattern:Toei.RH01.1.1",
+		"dc:title":              "RH01",
+		"dc:date":               "2025-12-01T03:00:00+09:00",
+		"odpt:operator":         testOperator,
+		"odpt:busstopPoleOrder": order,
+	}
+}
+
+func writeTestJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+}
+
+// fixturesのデータを返すcmd/fakeodptのサーバーにODPT APIを向ける
+func useFakeODPT(t *testing.T, fixtures map[string]interface{}) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, records := range fixtures {
+		writeTestJSON(t, filepath.Join(dir, name), records)
+	}
+	store, err := fakeodpt.LoadFixtures(dir)
+	require.NoError(t, err)
+	server := httptest.NewServer(store.Handler(false))
+	t.Cleanup(server.Close)
+
+	baseURL := odptAPIBaseURL
+	odptAPIBaseURL = server.URL
+	t.Cleanup(func() { odptAPIBaseURL = baseURL })
+}
+
+func TestUpdateOperatorAssets(t *testing.T) {
+	operator := &Operator{ID: testOperator, AssetName: "Toei"}
+	types := []string{"BusstopPole", "BusroutePattern"}
+	current := []interface{}{
+		testAssetPole("A", 35.6580, 139.7016),
+		testAssetPole("B", 35.6590, 139.7010),
+		testAssetPole("C", 35.6600, 139.7000),
+		testAssetPole("E", 35.6610, 139.7000),
+	}
+
+	t.Run("added, removed and moved", func(t *testing.T) {
+		useFakeODPT(t, map[string]interface{}{
+			"odpt_BusstopPole_Toei.json": []interface{}{
+				testAssetPole("A", 35.6580, 139.7016),
+				testAssetPole("C", 35.6609, 139.7000), // 約100m
+				testAssetPole("D", 35.6620, 139.7000),
+				testAssetPole("E", 35.66103, 139.7000), // 約3m
+			},
+			"odpt_BusroutePattern_Toei.json": []interface{}{testAssetPattern("A", "C", "D")},
+		})
+		dir := t.TempDir()
+		writeTestJSON(t, filepath.Join(dir, "odpt_BusstopPole_Toei.json"), current)
+
+		var out bytes.Buffer
+		err := updateOperatorAssets(context.Background(), http.DefaultClient, operator, types, dir, 10, false, &out)
+		require.NoError(t, err, out.String())
+
+		assert.Contains(t, out.String(), "added 1, removed 1, moved 1 (>= 10m)\n")
+		assert.Contains(t, out.String(), "    + odpt.BusstopPole:Toei.D D\n")
+		assert.Contains(t, out.String(), "    - odpt.BusstopPole:Toei.B\n")
+		assert.Contains(t, out.String(), "    ~ odpt.BusstopPole:Toei.C C moved 100.1m\n")
+		assert.NotContains(t, out.String(), "Toei.E E moved")
+		assert.Contains(t, out.String(), "new file (no current data)")
+
+		var written []ODPTBusstopPole
+		data, err := os.ReadFile(filepath.Join(dir, "odpt_BusstopPole_Toei.json"))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &written))
+		assert.Len(t, written, 4)
+		assert.FileExists(t, filepath.Join(dir, assetVersionsDir, "odpt_BusroutePattern_Toei_20251201T030000.json"))
+	})
+
+	t.Run("validation failure", func(t *testing.T) {
+		useFakeODPT(t, map[string]interface{}{
+			"odpt_BusstopPole_Toei.json":     []interface{}{testAssetPole("A", 35.6580, 139.7016)},
+			"odpt_BusroutePattern_Toei.json": []interface{}{testAssetPattern()},
+		})
+		dir := t.TempDir()
+		writeTestJSON(t, filepath.Join(dir, "odpt_BusstopPole_Toei.json"), current)
+		before, err := os.ReadFile(filepath.Join(dir, "odpt_BusstopPole_Toei.json"))
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		err = updateOperatorAssets(context.Background(), http.DefaultClient, operator, types, dir, 10, false, &out)
+		require.Error(t, err)
+		assert.Contains(t, out.String(), "error: odpt.BusroutePattern:Toei.RH01.1.1: empty odpt:busstopPoleOrder")
+
+		// 問題のない型のファイルも書き出さない
+		after, err := os.ReadFile(filepath.Join(dir, "odpt_BusstopPole_Toei.json"))
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+		assert.NoDirExists(t, filepath.Join(dir, assetVersionsDir))
+	})
+}
@@ -0,0 +1,338 @@
+package transit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// 同じ名前の標柱を1つのバス停にまとめる距離の上限 (m)。離れた同名のバス停をまとめないため
+const maxBusstopPoleSpread = 300.0
+
+// Busstop 標柱をまとめた親のバス停
+type Busstop struct {
+	ID       string             `json:"id"` // 子の標柱のsameAsから標柱番号を除いたもの
+	Title    string             `json:"title"`
+	Titles   map[string]string  `json:"titles,omitempty"` // lang=allの場合の多言語マップ
+	Kana     string             `json:"kana,omitempty"`
+	Lat      float64            `json:"lat"` // 子の標柱の重心
+	Long     float64            `json:"long"`
+	Operator string             `json:"operator"`
+	Poles    []BusstopChildPole `json:"poles"`
+
+	// 近傍検索時の検索地点から重心までの距離 (m)
+	Distance *float64 `json:"distance,omitempty"`
+
+	titleMap map[string]string // 言語タグごとの名称 (最初の標柱のもの)
+}
+
+// BusstopChildPole 親のバス停に含まれる標柱
+type BusstopChildPole struct {
+	SameAs           string                `json:"sameAs"`
+	Title            string                `json:"title"`
+	Titles           map[string]string     `json:"titles,omitempty"` // lang=allの場合の多言語マップ
+	Lat              float64               `json:"lat"`
+	Long             float64               `json:"long"`
+	BusroutePatterns []BusstopRoutePattern `json:"busroutePatterns"`
+
+	titleMap map[string]string // 言語タグごとの名称
+}
+
+// BusstopRoutePattern 標柱に停車する系統
+type BusstopRoutePattern struct {
+	SameAs   string `json:"sameAs"`
+	Title    string `json:"title"`
+	Busroute string `json:"busroute,omitempty"`
+	Index    int    `json:"index"` // 系統のbusstopPoleOrderにおける標柱の順序
+}
+
+// parentBusstopIndex 事業者ごとの親のバス停と空間インデックス
+type parentBusstopIndex struct {
+	busstops []Busstop
+	keys     []busstopSearchKeys // 名前の検索用 (最初の標柱のもの)
+	grid     *spatialGrid
+	byID     map[string]int
+}
+
+// 標柱のsameAsから末尾の標柱番号を除く (odpt.BusstopPole:Toei.ShibuyaStation.636.6 → odpt.BusstopPole:Toei.ShibuyaStation.636)
+func busstopPoleBaseID(sameAs string) string {
+	if i := strings.LastIndex(sameAs, "."); i > strings.Index(sameAs, ":") {
+		return sameAs[:i]
+	}
+	return sameAs
+}
+
+// 標柱のsameAsの基底部分か、同じ名前で近くにある標柱を1つの親のバス停にまとめ、系統のbusstopPoleOrderから標柱に停車する系統を付ける
+func newParentBusstopIndex(operator string, index *busstopIndex, odptPatterns []ODPTBusroutePattern) *parentBusstopIndex {
+	// 標柱ごとに停車する系統
+	servedBy := make(map[string][]BusstopRoutePattern)
+	for _, odptPattern := range odptPatterns {
+		for _, item := range odptPattern.BusstopPoleOrder {
+			servedBy[item.BusstopPole] = append(servedBy[item.BusstopPole], BusstopRoutePattern{
+				SameAs:   odptPattern.SameAs,
+				Title:    odptPattern.Title,
+				Busroute: odptPattern.Busroute,
+				Index:    item.Index,
+			})
+		}
+	}
+
+	// Union-Findで標柱をまとめる
+	parent := make([]int, len(index.busstops))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) {
+		if ra, rb := find(a), find(b); ra != rb {
+			// 先に現れた標柱を代表にして、親のバス停の順序を元のデータの順にする
+			parent[max(ra, rb)] = min(ra, rb)
+		}
+	}
+
+	byBase := make(map[string]int)
+	for i, busstop := range index.busstops {
+		base := busstopPoleBaseID(busstop.SameAs)
+		if first, ok := byBase[base]; ok {
+			union(first, i)
+		} else {
+			byBase[base] = i
+		}
+	}
+	for _, poles := range index.byTitle {
+		for a := 0; a < len(poles); a++ {
+			for b := a + 1; b < len(poles); b++ {
+				pa, pb := index.busstops[poles[a]], index.busstops[poles[b]]
+				if haversineDistance(pa.Lat, pa.Long, pb.Lat, pb.Long) <= maxBusstopPoleSpread {
+					union(poles[a], poles[b])
+				}
+			}
+		}
+	}
+
+	parents := &parentBusstopIndex{byID: make(map[string]int)}
+	positions := make(map[int]int) // 代表の標柱 → busstopsの位置
+	for i, busstop := range index.busstops {
+		root := find(i)
+		p, ok := positions[root]
+		if !ok {
+			p = len(parents.busstops)
+			positions[root] = p
+			parents.busstops = append(parents.busstops, Busstop{
+				ID:       busstopPoleBaseID(busstop.SameAs),
+				Title:    busstop.Title,
+				Kana:     busstop.Kana,
+				Operator: operator,
+				titleMap: busstop.titleMap,
+			})
+			parents.keys = append(parents.keys, index.keys[i])
+		}
+
+		patterns := servedBy[busstop.SameAs]
+		if patterns == nil {
+			patterns = []BusstopRoutePattern{}
+		}
+		parents.busstops[p].Poles = append(parents.busstops[p].Poles, BusstopChildPole{
+			SameAs:           busstop.SameAs,
+			Title:            busstop.Title,
+			Lat:              busstop.Lat,
+			Long:             busstop.Long,
+			BusroutePatterns: patterns,
+			titleMap:         busstop.titleMap,
+		})
+	}
+
+	lats := make([]float64, len(parents.busstops))
+	longs := make([]float64, len(parents.busstops))
+	for p := range parents.busstops {
+		busstop := &parents.busstops[p]
+		busstop.Lat, busstop.Long = poleCentroid(busstop.Poles)
+		lats[p], longs[p] = busstop.Lat, busstop.Long
+		// IDが重複する場合 (離れた同名の標柱が別のバス停になった場合など) は先に現れたものを引く
+		if _, ok := parents.byID[busstop.ID]; !ok {
+			parents.byID[busstop.ID] = p
+		}
+	}
+	parents.grid = newSpatialGrid(lats, longs)
+	return parents
+}
+
+// 座標のある標柱の重心
+func poleCentroid(poles []BusstopChildPole) (lat, long float64) {
+	count := 0
+	for _, pole := range poles {
+		if pole.Lat == 0 && pole.Long == 0 {
+			continue
+		}
+		lat += pole.Lat
+		long += pole.Long
+		count++
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return lat / float64(count), long / float64(count)
+}
+
+// 親のバス停を取得するハンドラー
+func GetBusstop(w http.ResponseWriter, r *http.Request) {
+	// クエリパラメータからoperatorを取得 (カンマ区切りで複数指定可)
+	operators, err := parseOperators(r.URL.Query().Get("operator"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// オプションのフィルタパラメータを取得
+	filterID := r.URL.Query().Get("id")
+	filterPole := r.URL.Query().Get("busstopPole")
+	titleQuery := newTitleQuery(r.URL.Query().Get("title"))
+
+	// 近傍検索のパラメータを取得
+	nearby, err := parseNearbyQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 表示範囲を取得
+	bbox, err := parseBoundingBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 出力形式を取得 (format=geojson またはAccept: application/geo+json)
+	geoJSON, err := wantsGeoJSON(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 名称の言語を取得 (langパラメータまたはAccept-Language)
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	static := getStaticData()
+	busstops := make([]Busstop, 0)
+	ranks := make([]int, 0)
+	for _, operator := range operators {
+		index, err := static.parentBusstops(operator)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Error reading file: %v", err)
+				http.Error(w, fmt.Sprintf("Data not found for operator: %s", operator), http.StatusNotFound)
+				return
+			}
+			log.Printf("Error loading busstop data: %v", err)
+			http.Error(w, "Error parsing data", http.StatusInternalServerError)
+			return
+		}
+
+		// フィルタリング処理
+		accept := func(i int) bool {
+			busstop := index.busstops[i]
+			if filterID != "" && busstop.ID != filterID {
+				return false
+			}
+			if filterPole != "" && !busstop.hasPole(filterPole) {
+				return false
+			}
+			if titleQuery != nil && titleQuery.match(index.keys[i]) == titleMatchNone {
+				return false
+			}
+			if bbox != nil && !bbox.contains(busstop.Lat, busstop.Long) {
+				return false
+			}
+			return true
+		}
+
+		switch {
+		case nearby != nil:
+			// 検索地点から近い順に返す
+			for _, match := range index.grid.nearby(nearby.lat, nearby.long, nearby.radius, nearby.limit, accept) {
+				busstop := index.busstops[match.index]
+				distance := math.Round(match.distance*10) / 10
+				busstop.Distance = &distance
+				busstops = append(busstops, busstop)
+			}
+		case bbox != nil:
+			for _, i := range index.grid.within(bbox, accept) {
+				busstops = append(busstops, index.busstops[i])
+				ranks = append(ranks, titleQuery.rank(index.keys[i]))
+			}
+		case filterID != "":
+			if i, ok := index.byID[filterID]; ok && accept(i) {
+				busstops = append(busstops, index.busstops[i])
+				ranks = append(ranks, titleQuery.rank(index.keys[i]))
+			}
+		default:
+			for i := range index.busstops {
+				if accept(i) {
+					busstops = append(busstops, index.busstops[i])
+					ranks = append(ranks, titleQuery.rank(index.keys[i]))
+				}
+			}
+		}
+	}
+
+	// 複数事業者の近傍検索結果を距離順にまとめる
+	if nearby != nil && len(operators) > 1 {
+		sort.SliceStable(busstops, func(i, j int) bool {
+			return *busstops[i].Distance < *busstops[j].Distance
+		})
+		if nearby.limit > 0 && len(busstops) > nearby.limit {
+			busstops = busstops[:nearby.limit]
+		}
+	}
+
+	// バス停名で検索した場合は完全一致、前方一致、部分一致の順に返す (近傍検索は距離順のまま)
+	if titleQuery != nil && nearby == nil {
+		sortByRank(busstops, ranks)
+	}
+
+	for i := range busstops {
+		busstops[i] = busstops[i].localized(lang)
+	}
+
+	// JSONレスポンスを返す
+	if geoJSON {
+		err = writeGeoJSON(w, parentBusstopFeatures(busstops))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(busstops)
+	}
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	logResult(r.Context(), operators, len(busstops))
+}
+
+// 標柱を含むか
+func (b Busstop) hasPole(sameAs string) bool {
+	for _, pole := range b.Poles {
+		if pole.SameAs == sameAs {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package transit
+
+// busstopIndex 事業者ごとのバス停データと索引
+type busstopIndex struct {
+	busstops []BusstopPole
+	grid     *spatialGrid
+	bySameAs map[string]int      // sameAs → busstopsの位置
+	byID     map[string]int      // @id (ucode) → busstopsの位置
+	byTitle  map[string][]int    // 正規化したバス停名 → busstopsの位置 (同名の標柱が複数ある)
+	keys     []busstopSearchKeys // busstopsと同じ順の検索用の文字列
+	names    []busstopName       // 正規化したバス停名ごとのまとまり
+	prefixes []namePrefix        // バス停名の前方一致の索引
+}
+
+func newBusstopIndex(odptBusstops []ODPTBusstopPole) *busstopIndex {
+	index := &busstopIndex{
+		busstops: make([]BusstopPole, 0, len(odptBusstops)),
+		bySameAs: make(map[string]int, len(odptBusstops)),
+		byID:     make(map[string]int, len(odptBusstops)),
+		byTitle:  make(map[string][]int),
+		keys:     make([]busstopSearchKeys, 0, len(odptBusstops)),
+	}
+	lats := make([]float64, 0, len(odptBusstops))
+	longs := make([]float64, 0, len(odptBusstops))
+
+	for i, odptBusstop := range odptBusstops {
+		busstop := BusstopPole{
+			ID:       odptBusstop.ID,
+			Type:     odptBusstop.Type,
+			SameAs:   odptBusstop.SameAs,
+			Date:     odptBusstop.Date,
+			Title:    busstopTitle(odptBusstop),
+			Kana:     busstopKana(odptBusstop),
+			Long:     odptBusstop.Long,
+			Lat:      odptBusstop.Lat,
+			Operator: odptBusstop.Operator,
+		}
+		busstop.titleMap = odptTitles(odptBusstop.Title, busstop.Title)
+		keys := newBusstopSearchKeys(busstop.Title, busstop.Kana, odptTitleIn(odptBusstop.Title, "en"))
+
+		index.busstops = append(index.busstops, busstop)
+		index.keys = append(index.keys, keys)
+		lats = append(lats, odptBusstop.Lat)
+		longs = append(longs, odptBusstop.Long)
+
+		// sameAsと@idが重複している場合は先に現れたものを使う
+		if _, ok := index.bySameAs[busstop.SameAs]; !ok && busstop.SameAs != "" {
+			index.bySameAs[busstop.SameAs] = i
+		}
+		if _, ok := index.byID[busstop.ID]; !ok && busstop.ID != "" {
+			index.byID[busstop.ID] = i
+		}
+		if keys.title != "" {
+			index.byTitle[keys.title] = append(index.byTitle[keys.title], i)
+		}
+	}
+
+	index.grid = newSpatialGrid(lats, longs)
+	index.buildNameIndex()
+	return index
+}
+
+// sameAs、またはsameAsが空の場合は@idからバス停を引く
+func (index *busstopIndex) lookup(sameAs, id string) (int, bool) {
+	if sameAs != "" {
+		i, ok := index.bySameAs[sameAs]
+		return i, ok
+	}
+	i, ok := index.byID[id]
+	return i, ok
+}
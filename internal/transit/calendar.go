@@ -0,0 +1,123 @@
+package transit
+
+import (
+	"math"
+	"time"
+)
+
+// 時刻表の時刻のタイムゾーン (日本標準時、夏時間なし)
+var japanTime = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// 運行日の種類に対応するODPTのカレンダー
+const (
+	calendarWeekday  = "odpt.Calendar:Weekday"
+	calendarSaturday = "odpt.Calendar:Saturday"
+	calendarHoliday  = "odpt.Calendar:Holiday"
+)
+
+// 運行日の曜日の位置 (月曜 0 〜 日曜 6)。祝日は日曜として扱う
+// gtfsCalendarDaysと組み合わせて、その日に走る時刻表のカレンダーを判定する
+func serviceDaySlot(date time.Time) int {
+	if isJapaneseHoliday(date) {
+		return 6
+	}
+	return (int(date.Weekday()) + 6) % 7
+}
+
+// 運行日の種類 (平日・土曜・休日) のカレンダー
+func serviceDayCalendar(date time.Time) string {
+	switch serviceDaySlot(date) {
+	case 5:
+		return calendarSaturday
+	case 6:
+		return calendarHoliday
+	}
+	return calendarWeekday
+}
+
+// 時刻表のカレンダーが運行日 (serviceDaySlotの位置) に使われるか
+// 個別の日付を指定したカレンダーなど、曜日で表せないものは使わない
+func calendarApplies(calendar string, slot int) bool {
+	days, ok := gtfsCalendarDays[calendar]
+	return ok && days[slot]
+}
+
+// 国民の祝日か。振替休日と国民の休日 (祝日に挟まれた平日) を含む
+func isJapaneseHoliday(date time.Time) bool {
+	y, m, d := date.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, japanTime)
+	if isNationalHoliday(day) {
+		return true
+	}
+
+	// 振替休日: 日曜の祝日から続く祝日の翌日
+	for prev := day.AddDate(0, 0, -1); isNationalHoliday(prev); prev = prev.AddDate(0, 0, -1) {
+		if prev.Weekday() == time.Sunday {
+			return true
+		}
+	}
+
+	// 国民の休日: 前後が祝日の日 (日曜を除く)
+	return day.Weekday() != time.Sunday && isNationalHoliday(day.AddDate(0, 0, -1)) && isNationalHoliday(day.AddDate(0, 0, 1))
+}
+
+// 祝日法で日付が決まる祝日か (2000年以降の規則)。振替休日と国民の休日は含まない
+func isNationalHoliday(date time.Time) bool {
+	y, m, d := date.Year(), date.Month(), date.Day()
+	week := (d-1)/7 + 1 // その月の第何週の曜日か
+	monday := date.Weekday() == time.Monday
+
+	// 東京オリンピック・パラリンピックに合わせて移動した年と、即位に伴う祝日
+	switch y {
+	case 2019:
+		if (m == time.May && d == 1) || (m == time.October && d == 22) {
+			return true
+		}
+	case 2020:
+		switch {
+		case m == time.July && (d == 23 || d == 24), m == time.August && d == 10:
+			return true
+		case m == time.July, m == time.August && d == 11, m == time.October:
+			return false
+		}
+	case 2021:
+		switch {
+		case m == time.July && (d == 22 || d == 23), m == time.August && d == 8:
+			return true
+		case m == time.July, m == time.August && d == 11, m == time.October:
+			return false
+		}
+	}
+
+	switch m {
+	case time.January:
+		return d == 1 || (monday && week == 2) // 元日、成人の日
+	case time.February:
+		return d == 11 || (d == 23 && y >= 2020) // 建国記念の日、天皇誕生日
+	case time.March:
+		return d == equinoxDay(y, 20.8431) // 春分の日
+	case time.April:
+		return d == 29 // 昭和の日 (みどりの日)
+	case time.May:
+		return d == 3 || (d == 4 && y >= 2007) || d == 5 // 憲法記念日、みどりの日 (2006年までは国民の休日)、こどもの日
+	case time.July:
+		return (y >= 2003 && monday && week == 3) || (y < 2003 && d == 20) // 海の日
+	case time.August:
+		return y >= 2016 && d == 11 // 山の日
+	case time.September:
+		return (y >= 2003 && monday && week == 3) || (y < 2003 && d == 15) || d == equinoxDay(y, 23.2488) // 敬老の日、秋分の日
+	case time.October:
+		return monday && week == 2 // スポーツの日 (体育の日)
+	case time.November:
+		return d == 3 || d == 23 // 文化の日、勤労感謝の日
+	case time.December:
+		return d == 23 && y >= 1989 && y <= 2018 // 天皇誕生日 (平成)
+	}
+	return false
+}
+
+// 春分の日・秋分の日の日付 (1980〜2099年の近似式)
+func equinoxDay(year int, base float64) int {
+	n := float64(year - 1980)
+	return int(math.Floor(base + 0.242194*n - math.Floor(n/4)))
+}
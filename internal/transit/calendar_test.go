@@ -0,0 +1,82 @@
+package transit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsJapaneseHoliday(t *testing.T) {
+	tests := []struct {
+		date string
+		want bool
+		note string
+	}{
+		{date: "2026-01-01", want: true, note: "元日"},
+		{date: "2026-01-12", want: true, note: "成人の日 (1月第2月曜)"},
+		{date: "2026-01-05", want: false, note: "1月第1月曜"},
+		{date: "2026-02-11", want: true, note: "建国記念の日"},
+		{date: "2026-02-23", want: true, note: "天皇誕生日"},
+		{date: "2018-12-23", want: true, note: "平成の天皇誕生日"},
+		{date: "2019-12-23", want: false, note: "令和では平日"},
+		{date: "2026-03-20", want: true, note: "春分の日"},
+		{date: "2026-04-29", want: true, note: "昭和の日"},
+		{date: "2026-05-06", want: true, note: "憲法記念日 (日曜) の振替休日"},
+		{date: "2026-05-07", want: false, note: "振替休日の翌日"},
+		{date: "2026-07-20", want: true, note: "海の日 (7月第3月曜)"},
+		{date: "2026-08-11", want: true, note: "山の日"},
+		{date: "2026-09-21", want: true, note: "敬老の日"},
+		{date: "2026-09-22", want: true, note: "敬老の日と秋分の日に挟まれた国民の休日"},
+		{date: "2026-09-23", want: true, note: "秋分の日"},
+		{date: "2026-10-12", want: true, note: "スポーツの日 (10月第2月曜)"},
+		{date: "2026-10-16", want: false, note: "平日"},
+		{date: "2026-11-03", want: true, note: "文化の日"},
+		{date: "2026-11-23", want: true, note: "勤労感謝の日"},
+		{date: "2025-11-24", want: true, note: "勤労感謝の日 (日曜) の振替休日"},
+		{date: "2019-05-01", want: true, note: "即位の日"},
+		{date: "2019-10-22", want: true, note: "即位礼正殿の儀"},
+		{date: "2020-07-24", want: true, note: "東京オリンピックで移動したスポーツの日"},
+		{date: "2020-10-12", want: false, note: "2020年は7月に移動"},
+		{date: "2021-08-09", want: true, note: "山の日 (8/8 日曜) の振替休日"},
+		{date: "2021-08-11", want: false, note: "2021年は8/8に移動"},
+		{date: "2026-12-31", want: false, note: "年末は祝日ではない"},
+		{date: "2002-07-20", want: true, note: "2002年までの海の日"},
+		{date: "2002-07-15", want: false, note: "2002年の7月第3月曜"},
+		{date: "2002-09-15", want: true, note: "2002年までの敬老の日 (日曜)"},
+		{date: "2002-09-16", want: true, note: "敬老の日 (日曜) の振替休日"},
+		{date: "2003-07-21", want: true, note: "2003年からの海の日"},
+		{date: "2003-09-15", want: true, note: "2003年からの敬老の日 (9月第3月曜)"},
+		{date: "2003-05-04", want: false, note: "2006年までは日曜の5/4は休日ではない"},
+		{date: "2003-05-06", want: false, note: "日曜の5/4からは振り替えない"},
+		{date: "2004-05-04", want: true, note: "憲法記念日とこどもの日に挟まれた国民の休日"},
+		{date: "2008-05-06", want: true, note: "みどりの日 (日曜) の振替休日"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.date, func(t *testing.T) {
+			date, err := time.ParseInLocation("2006-01-02", tt.date, japanTime)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, isJapaneseHoliday(date), tt.note)
+		})
+	}
+}
+
+func TestServiceDayCalendar(t *testing.T) {
+	tests := []struct {
+		date string
+		want string
+	}{
+		{date: "2026-10-16", want: calendarWeekday},
+		{date: "2026-10-17", want: calendarSaturday},
+		{date: "2026-10-18", want: calendarHoliday},
+		{date: "2026-11-03", want: calendarHoliday}, // 火曜の祝日
+		{date: "2028-01-01", want: calendarHoliday}, // 土曜の祝日
+	}
+
+	for _, tt := range tests {
+		date, err := time.ParseInLocation("2006-01-02", tt.date, japanTime)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, serviceDayCalendar(date), tt.date)
+	}
+}
@@ -0,0 +1,285 @@
+package transit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// キャプチャファイルの既定の最大サイズ (MB)。超えたらローテーションする
+const defaultCaptureMaxMB = 100
+
+// ローテーションで残す古いキャプチャファイルの数 (<ファイル名>.1 〜 .5)
+const maxCaptureBackups = 5
+
+// captureRecord キャプチャファイルの1行。ODPT APIのodpt:Busへの1回のリクエストと応答
+type captureRecord struct {
+	Time     time.Time       `json:"time"`
+	Operator string          `json:"operator"`
+	Query    string          `json:"query"` // 正規化したクエリ (コンシューマーキーは含まない)
+	Status   int             `json:"status"`
+	Body     json.RawMessage `json:"body,omitempty"`
+}
+
+// captureWriter キャプチャをJSON Linesで書き出し、最大サイズを超えたらローテーションする
+type captureWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+// 環境変数 ODPT_CAPTURE_FILE が設定されている場合のみ有効
+var odptCapture *captureWriter
+
+func newCaptureWriter(path string, maxBytes int64) (*captureWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	c := &captureWriter{path: path, maxBytes: maxBytes}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *captureWriter) open() error {
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	c.file, c.size = file, info.Size()
+	return nil
+}
+
+func (c *captureWriter) write(record captureRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size > 0 && c.size+int64(len(line)) > c.maxBytes {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	return err
+}
+
+// 現在のファイルを <ファイル名>.1 に、既存の .1 以降を1つずつずらして新しいファイルを開く
+func (c *captureWriter) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	for i := maxCaptureBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+	}
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		return err
+	}
+	log.Printf("Rotated capture file: %s", c.path)
+	return c.open()
+}
+
+// ODPT APIの応答をキャプチャする (キャプチャが無効な場合は何もしない)
+func captureODPTResponse(operator string, filters url.Values, status int, body []byte) {
+	if odptCapture == nil {
+		return
+	}
+	record := captureRecord{
+		Time:     time.Now(),
+		Operator: operator,
+		Query:    odptBusCacheKey(operator, filters),
+		Status:   status,
+	}
+	if status == http.StatusOK && json.Valid(body) {
+		record.Body = body
+	}
+	if err := odptCapture.write(record); err != nil {
+		log.Printf("Error writing capture: %v", err)
+	}
+}
+
+// replaySource キャプチャファイルの応答を、記録時の間隔 (またはその速度倍) で再生する
+type replaySource struct {
+	records []captureRecord  // 成功した応答のみ、時刻順
+	byQuery map[string][]int // クエリごとのrecordsの添字 (時刻順)
+	speed   float64
+	started time.Time
+}
+
+func loadReplaySource(path string, speed float64) (*replaySource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	source := &replaySource{byQuery: make(map[string][]int), speed: speed}
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		// 大きな事業者の応答は1行が数MBになるためbufio.Scannerは使わない
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record captureRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+			if record.Status == http.StatusOK && len(record.Body) > 0 {
+				source.records = append(source.records, record)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(source.records) == 0 {
+		return nil, fmt.Errorf("no successful odpt:Bus responses in %s", path)
+	}
+
+	sort.SliceStable(source.records, func(i, j int) bool {
+		return source.records[i].Time.Before(source.records[j].Time)
+	})
+	for i, record := range source.records {
+		source.byQuery[record.Query] = append(source.byQuery[record.Query], i)
+	}
+
+	source.started = time.Now()
+	return source, nil
+}
+
+// 再生中の時刻。キャプチャの最後まで進んだら最初に戻る
+func (s *replaySource) now(realNow time.Time) time.Time {
+	first := s.records[0].Time
+	span := s.records[len(s.records)-1].Time.Sub(first)
+	elapsed := time.Duration(float64(realNow.Sub(s.started)) * s.speed)
+	if span > 0 {
+		elapsed %= span
+	} else {
+		elapsed = 0
+	}
+	return first.Add(elapsed)
+}
+
+// 再生中の時刻の時点で最後に記録された応答を返す
+// 同じクエリの記録がない場合は、事業者のフィルタなしの記録を使いフィルタを適用する
+func (s *replaySource) fetch(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+	indexes, exact := s.byQuery[odptBusCacheKey(operator, filters)]
+	if !exact {
+		indexes = s.byQuery[odptBusCacheKey(operator, nil)]
+	}
+	if len(indexes) == 0 {
+		return nil, &upstreamError{http.StatusNotFound, "No captured data for operator: " + operator, false}
+	}
+
+	realNow := time.Now()
+	replayNow := s.now(realNow)
+	i := sort.Search(len(indexes), func(i int) bool {
+		return s.records[indexes[i]].Time.After(replayNow)
+	})
+	if i > 0 {
+		i--
+	}
+	record := s.records[indexes[i]]
+
+	var odptBuses []ODPTBus
+	if err := json.Unmarshal(record.Body, &odptBuses); err != nil {
+		log.Printf("Error parsing captured response: %v", err)
+		return nil, &upstreamError{http.StatusInternalServerError, "Error parsing captured response", false}
+	}
+
+	// 記録時の経過時間を保つよう、日時を再生中の時刻から現在時刻にずらす
+	offset := realNow.Sub(replayNow)
+	for i := range odptBuses {
+		odptBuses[i].Date = shiftTimestamp(odptBuses[i].Date, offset)
+		odptBuses[i].Valid = shiftTimestamp(odptBuses[i].Valid, offset)
+		odptBuses[i].FromBusstopPoleTime = shiftTimestamp(odptBuses[i].FromBusstopPoleTime, offset)
+	}
+	if exact {
+		return odptBuses, nil
+	}
+	return filterODPTBuses(odptBuses, filters), nil
+}
+
+func shiftTimestamp(value string, offset time.Duration) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.Add(offset).In(t.Location()).Format(time.RFC3339)
+}
+
+// 環境変数に応じてキャプチャまたは再生を有効にする
+//
+//	ODPT_CAPTURE_FILE    odpt:Busの応答を書き出すファイル
+//	ODPT_CAPTURE_MAX_MB  ローテーションするサイズ (MB)
+//	ODPT_REPLAY_FILE     ODPT APIの代わりに再生するキャプチャファイル
+//	ODPT_REPLAY_SPEED    再生速度 (2で2倍速)
+func SetupCaptureAndReplay() error {
+	if path := os.Getenv("ODPT_REPLAY_FILE"); path != "" {
+		speed := 1.0
+		if value := os.Getenv("ODPT_REPLAY_SPEED"); value != "" {
+			var err error
+			if speed, err = strconv.ParseFloat(value, 64); err != nil || speed <= 0 {
+				return fmt.Errorf("invalid ODPT_REPLAY_SPEED: %s", value)
+			}
+		}
+		source, err := loadReplaySource(path, speed)
+		if err != nil {
+			return err
+		}
+		sharedBusCache.fetch = source.fetch
+		// 再生速度に合わせてキャッシュの有効期間を縮める
+		sharedBusCache.ttl = time.Duration(float64(sharedBusCache.ttl) / speed)
+
+		first, last := source.records[0].Time, source.records[len(source.records)-1].Time
+		log.Printf("Replaying %d captured responses from %s (%s - %s) at %gx speed", len(source.records), path,
+			first.Format(time.RFC3339), last.Format(time.RFC3339), speed)
+		return nil
+	}
+
+	if path := os.Getenv("ODPT_CAPTURE_FILE"); path != "" {
+		maxMB := defaultCaptureMaxMB
+		if value := os.Getenv("ODPT_CAPTURE_MAX_MB"); value != "" {
+			var err error
+			if maxMB, err = strconv.Atoi(value); err != nil || maxMB <= 0 {
+				return fmt.Errorf("invalid ODPT_CAPTURE_MAX_MB: %s", value)
+			}
+		}
+		writer, err := newCaptureWriter(path, int64(maxMB)*1024*1024)
+		if err != nil {
+			return err
+		}
+		odptCapture = writer
+		log.Printf("Capturing odpt:Bus responses to %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package transit
+
+import (
+	"log"
+	"time"
+)
+
+// サーキットブレーカーの設定
+const (
+	breakerThreshold   = 3               // 連続して何回失敗したら上流へのリクエストを止めるか
+	breakerBaseBackoff = 5 * time.Second // 最初に止める時間。失敗が続くたびに倍にする
+	breakerMaxBackoff  = 5 * time.Minute // 止める時間の上限
+)
+
+// circuitBreaker 上流の一時的な障害が続いた場合に、指数バックオフでリクエストを止める
+// 止めている間が過ぎると1回だけ試し、成功すれば元に戻り、失敗すれば止める時間を延ばす
+// 呼び出し側のロックで保護して使う
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// 上流へのリクエストを送ってよいか判定する
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// 試しのリクエストの結果が出るまで他のリクエストは止めておく
+	b.openUntil = now.Add(b.backoff())
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	if b.failures >= breakerThreshold {
+		log.Printf("ODPT API recovered, closing circuit breaker")
+	}
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = now.Add(b.backoff())
+		log.Printf("ODPT API failed %d times in a row, pausing requests until %s", b.failures, b.openUntil.Format(time.RFC3339))
+	}
+}
+
+// 現在の連続失敗回数に応じた止める時間
+func (b *circuitBreaker) backoff() time.Duration {
+	backoff := breakerBaseBackoff
+	for i := breakerThreshold; i < b.failures && backoff < breakerMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > breakerMaxBackoff {
+		backoff = breakerMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,535 @@
+package transit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 発車案内の件数の既定値と上限
+const (
+	defaultDepartureLimit = 10
+	maxDepartureLimit     = 50
+)
+
+// 遅れている便を車両と対応付けるため、基準時刻からさかのぼって時刻表を探す時間
+const departureLookback = time.Hour
+
+// 時刻表から発車案内を探す範囲 (基準時刻から)
+const departureHorizon = 24 * time.Hour
+
+// 車両が直近の停留所を発車した時刻と、その停留所の時刻表の便の時刻のずれの上限
+const maxDepartureDeviation = 30 * time.Minute
+
+// BusstopPoleDepartures /busstoppole/{sameAs}/departures のレスポンス
+type BusstopPoleDepartures struct {
+	BusstopPole BusstopPoleSummary `json:"busstopPole"`
+	ServiceDate string             `json:"serviceDate"` // 基準時刻の運行日 (YYYY-MM-DD)。前日の深夜便が残っている間は前日
+	Calendar    string             `json:"calendar"`    // 運行日の種類 (odpt.Calendar:Weekday, Saturday, Holiday)
+	Departures  []Departure        `json:"departures"`
+}
+
+// Departure 標柱を発車する1便
+type Departure struct {
+	ScheduledTime          *time.Time        `json:"scheduledTime,omitempty"` // 時刻表の発車時刻
+	EstimatedTime          *time.Time        `json:"estimatedTime,omitempty"` // 走行中の車両から推定した発車時刻
+	Delay                  *int              `json:"delay,omitempty"`         // 時刻表からの遅れ (秒)
+	Realtime               bool              `json:"realtime"`                // 走行中の車両と対応付けたか
+	RouteTitle             string            `json:"routeTitle"`
+	RouteTitles            map[string]string `json:"routeTitles,omitempty"`       // lang=allの場合の多言語マップ
+	Destination            string            `json:"destination,omitempty"`       // 行先表示
+	DestinationTitles      map[string]string `json:"destinationTitles,omitempty"` // lang=allの場合の多言語マップ
+	DestinationBusstopPole string            `json:"destinationBusstopPole,omitempty"`
+	BusroutePattern        string            `json:"busroutePattern,omitempty"`
+	Busroute               string            `json:"busroute,omitempty"`
+	Calendar               string            `json:"calendar,omitempty"` // 時刻表のカレンダー
+	Vehicle                string            `json:"vehicle,omitempty"`  // 車両のID (/location/busvehicle のid)
+	BusNumber              string            `json:"busNumber,omitempty"`
+	StopsAway              *int              `json:"stopsAway,omitempty"` // 車両がこの標柱に着くまでの停留所の数
+}
+
+// scheduledDeparture 標柱の時刻表の1便
+type scheduledDeparture struct {
+	seconds         int // 運行日の0時からの発車時刻 (秒)。深夜便は24時以降
+	calendar        string
+	pattern         string
+	busroute        string
+	title           string // 時刻表のdc:title
+	destination     string
+	destinationPole string
+}
+
+// poleTimetables 標柱のsameAs → 標柱を発車する便 (運行日の発車時刻の順)
+type poleTimetables map[string][]scheduledDeparture
+
+// 標柱時刻表を標柱ごとの便の一覧にする。降車専用の便 (終点など) は含めない
+func newPoleTimetables(odptTimetables []ODPTBusstopPoleTimetable) poleTimetables {
+	timetables := make(poleTimetables)
+
+	// 系統やカレンダーの文字列は便の数だけ繰り返されるため、1つにまとめてメモリを抑える
+	interned := make(map[string]string)
+	intern := func(s string) string {
+		if v, ok := interned[s]; ok {
+			return v
+		}
+		interned[s] = s
+		return s
+	}
+
+	for _, odptTimetable := range odptTimetables {
+		for _, item := range odptTimetable.BusstopPoleTimetableObject {
+			if item.CanGetOn != nil && !*item.CanGetOn {
+				continue
+			}
+			value := item.DepartureTime
+			if value == "" {
+				value = item.ArrivalTime
+			}
+			seconds, err := parseTimetableTime(value, item.IsMidnight, -1)
+			if err != nil {
+				log.Printf("Skipping departure %q in %s: %v", value, odptTimetable.SameAs, err)
+				continue
+			}
+			timetables[odptTimetable.BusstopPole] = append(timetables[odptTimetable.BusstopPole], scheduledDeparture{
+				seconds:         seconds,
+				calendar:        intern(odptTimetable.Calendar),
+				pattern:         intern(item.BusroutePattern),
+				busroute:        intern(odptTimetable.Busroute),
+				title:           intern(odptTimetable.Title),
+				destination:     intern(item.DestinationSign),
+				destinationPole: intern(item.DestinationBusstopPole),
+			})
+		}
+	}
+
+	for _, departures := range timetables {
+		sort.SliceStable(departures, func(i, j int) bool {
+			return departures[i].seconds < departures[j].seconds
+		})
+	}
+	return timetables
+}
+
+// timedDeparture 運行日に当てはめた便
+type timedDeparture struct {
+	*scheduledDeparture
+	day time.Time // 運行日の0時
+	at  time.Time
+}
+
+// 標柱をfromからtoまでに発車する便のうち、運行日のカレンダーに合うものを発車時刻の順に返す
+// 深夜便は前日の運行日の時刻表に載っているため、前日の運行日から探す
+func (t poleTimetables) between(pole string, from, to time.Time) []timedDeparture {
+	departures := t[pole]
+	if len(departures) == 0 {
+		return nil
+	}
+
+	var result []timedDeparture
+	y, m, d := from.In(japanTime).Date()
+	for day := time.Date(y, m, d-1, 0, 0, 0, 0, japanTime); !day.After(to); day = day.AddDate(0, 0, 1) {
+		slot := serviceDaySlot(day)
+		for i := range departures {
+			departure := &departures[i]
+			if !calendarApplies(departure.calendar, slot) {
+				continue
+			}
+			at := day.Add(time.Duration(departure.seconds) * time.Second)
+			if at.Before(from) || at.After(to) {
+				continue
+			}
+			result = append(result, timedDeparture{departure, day, at})
+		}
+	}
+
+	// 前日の深夜便と当日の早朝の便が前後するため並べ直す
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].at.Before(result[j].at)
+	})
+	return result
+}
+
+// 基準時刻の運行日の0時。parseTimetableTimeと同じく深夜便は前日の運行日の24時以降とするため、
+// 前日の運行日の深夜便がまだこの標柱を発車していない間は前日を運行日とする
+func (t poleTimetables) serviceDay(pole string, now time.Time) time.Time {
+	now = now.In(japanTime)
+	y, m, d := now.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, japanTime)
+	previous := day.AddDate(0, 0, -1)
+	slot := serviceDaySlot(previous)
+
+	// 便は発車時刻の順のため、24時以降の便を遅い方から探す
+	departures := t[pole]
+	for i := len(departures) - 1; i >= 0 && departures[i].seconds >= 24*60*60; i-- {
+		if !calendarApplies(departures[i].calendar, slot) {
+			continue
+		}
+		if !previous.Add(time.Duration(departures[i].seconds) * time.Second).Before(now) {
+			return previous
+		}
+		break
+	}
+	return day
+}
+
+// 運行日の同じ系統の便のうち、標柱を何番目に発車する便か (0から)
+func (t poleTimetables) tripRank(pole string, trip timedDeparture) int {
+	slot := serviceDaySlot(trip.day)
+	rank := 0
+	for i := range t[pole] {
+		departure := &t[pole][i]
+		if departure == trip.scheduledDeparture {
+			break
+		}
+		if departure.pattern == trip.pattern && calendarApplies(departure.calendar, slot) {
+			rank++
+		}
+	}
+	return rank
+}
+
+// 運行日の同じ系統の便のうち、標柱をrank番目に発車する便
+func (t poleTimetables) tripAt(pole, pattern string, day time.Time, rank int) (timedDeparture, bool) {
+	slot := serviceDaySlot(day)
+	for i := range t[pole] {
+		departure := &t[pole][i]
+		if departure.pattern != pattern || !calendarApplies(departure.calendar, slot) {
+			continue
+		}
+		if rank == 0 {
+			return timedDeparture{departure, day, day.Add(time.Duration(departure.seconds) * time.Second)}, true
+		}
+		rank--
+	}
+	return timedDeparture{}, false
+}
+
+// departureBoard 1つの標柱の発車案内を組み立てる
+type departureBoard struct {
+	sameAs     string
+	now        time.Time
+	timetables poleTimetables
+	patterns   map[string]*routePattern
+	summaries  map[string]*BusstopPoleSummary
+	scheduled  []timedDeparture // 基準時刻の前後に標柱を発車する時刻表の便
+	matched    []bool           // scheduledのうち走行中の車両と対応付けた便
+	departures []Departure
+}
+
+func newDepartureBoard(sameAs string, now time.Time, timetables poleTimetables, patterns map[string]*routePattern, summaries map[string]*BusstopPoleSummary) *departureBoard {
+	scheduled := timetables.between(sameAs, now.Add(-departureLookback), now.Add(departureHorizon))
+	return &departureBoard{
+		sameAs:     sameAs,
+		now:        now,
+		timetables: timetables,
+		patterns:   patterns,
+		summaries:  summaries,
+		scheduled:  scheduled,
+		matched:    make([]bool, len(scheduled)),
+	}
+}
+
+// 系統のbusstopPoleOrderでまだこの標柱に着いていない車両を発車案内に加える
+func (b *departureBoard) addBus(bus Bus) {
+	pattern := b.patterns[bus.BusroutePattern]
+	if pattern == nil {
+		return
+	}
+	target, ok := pattern.poleIndex[b.sameAs]
+	if !ok {
+		return
+	}
+
+	// 車両が最後に発車した停留所の順序 (始発の停留所の発車前は次の停留所の1つ前)
+	var reached int
+	switch {
+	case bus.FromBusstopPole != "":
+		if reached, ok = pattern.poleIndex[bus.FromBusstopPole]; !ok {
+			return
+		}
+	case bus.ToBusstopPole != "":
+		if reached, ok = pattern.poleIndex[bus.ToBusstopPole]; !ok {
+			return
+		}
+		reached--
+	default:
+		return
+	}
+	if target <= reached {
+		return
+	}
+
+	stopsAway := target - reached
+	departure := Departure{
+		Realtime:        true,
+		RouteTitle:      pattern.title,
+		BusroutePattern: bus.BusroutePattern,
+		Vehicle:         bus.ID,
+		BusNumber:       bus.BusNumber,
+		StopsAway:       &stopsAway,
+	}
+
+	if trip, delay, ok := b.matchTrip(bus); ok {
+		// 時刻表の便の発車時刻に遅れを加える
+		for i, scheduled := range b.scheduled {
+			if scheduled.scheduledDeparture == trip.scheduledDeparture && scheduled.day.Equal(trip.day) {
+				b.matched[i] = true
+			}
+		}
+		departure.setScheduled(trip, b.patterns)
+		seconds := int(delay.Seconds())
+		departure.EstimatedTime = b.notBeforeNow(trip.at.Add(delay))
+		departure.Delay = &seconds
+	} else {
+		// 時刻表と対応付けられない場合は、残りの距離と平均速度から推定し、行先は系統の終点とする
+		if bus.FromBusstopPoleTime != nil {
+			distance := b.remainingDistance(pattern, reached, target)
+			estimated := bus.FromBusstopPoleTime.Add(time.Duration(distance / assumedBusSpeed * float64(time.Second)))
+			departure.EstimatedTime = b.notBeforeNow(estimated)
+		}
+		if n := len(pattern.poles); n > 0 {
+			departure.DestinationBusstopPole = pattern.poles[n-1]
+			if terminal := b.summaries[pattern.poles[n-1]]; terminal != nil {
+				departure.Destination = terminal.Title
+			}
+		}
+	}
+	b.departures = append(b.departures, departure)
+}
+
+// 車両をこの標柱の時刻表の便と対応付け、その便と遅れを返す
+// 車両が直近に発車した停留所の時刻表で、発車時刻に最も近い同じ系統の便から遅れを求める
+// 系統の便はすべての停留所を同じ順に通るため、その停留所で何番目の便かからこの標柱の便を決める
+func (b *departureBoard) matchTrip(bus Bus) (timedDeparture, time.Duration, bool) {
+	if bus.FromBusstopPole == "" || bus.FromBusstopPoleTime == nil {
+		return timedDeparture{}, 0, false
+	}
+	departed := *bus.FromBusstopPoleTime
+
+	var origin *timedDeparture
+	for _, candidate := range b.timetables.between(bus.FromBusstopPole, departed.Add(-maxDepartureDeviation), departed.Add(maxDepartureDeviation)) {
+		if candidate.pattern != bus.BusroutePattern {
+			continue
+		}
+		if origin == nil || absDuration(candidate.at.Sub(departed)) < absDuration(origin.at.Sub(departed)) {
+			candidate := candidate
+			origin = &candidate
+		}
+	}
+	if origin == nil {
+		return timedDeparture{}, 0, false
+	}
+
+	rank := b.timetables.tripRank(bus.FromBusstopPole, *origin)
+	trip, ok := b.timetables.tripAt(b.sameAs, bus.BusroutePattern, origin.day, rank)
+	if !ok || trip.at.Before(origin.at) {
+		return timedDeparture{}, 0, false
+	}
+	return trip, departed.Sub(origin.at), true
+}
+
+// 系統の停留所の順序でreachedからtargetまでのバス停間の直線距離の合計 (m)
+func (b *departureBoard) remainingDistance(pattern *routePattern, reached, target int) float64 {
+	var distance float64
+	var previous *BusstopPoleSummary
+	for _, pole := range pattern.poles {
+		if i := pattern.poleIndex[pole]; i < reached || i > target {
+			continue
+		}
+		summary := b.summaries[pole]
+		if summary == nil {
+			continue
+		}
+		if previous != nil {
+			distance += haversineDistance(previous.Lat, previous.Long, summary.Lat, summary.Long)
+		}
+		previous = summary
+	}
+	return distance
+}
+
+// 推定時刻が基準時刻より前の場合 (遅れが増えている車両など) は基準時刻にする
+func (b *departureBoard) notBeforeNow(t time.Time) *time.Time {
+	if t.Before(b.now) {
+		t = b.now
+	}
+	t = t.In(japanTime).Truncate(time.Second)
+	return &t
+}
+
+// 走行中の車両と対応付けなかった時刻表の便のうち、基準時刻以降のものを加える
+func (b *departureBoard) addScheduled() {
+	for i, scheduled := range b.scheduled {
+		if b.matched[i] || scheduled.at.Before(b.now) {
+			continue
+		}
+		var departure Departure
+		departure.setScheduled(scheduled, b.patterns)
+		b.departures = append(b.departures, departure)
+	}
+}
+
+// 発車の早い順に最大limit件を返す。時刻の分からない車両は停留所の近い順に最後に並べる
+func (b *departureBoard) result(limit int) []Departure {
+	departures := b.departures
+	sort.SliceStable(departures, func(i, j int) bool {
+		a, c := departures[i].expectedTime(), departures[j].expectedTime()
+		switch {
+		case a.IsZero() != c.IsZero():
+			return c.IsZero()
+		case a.IsZero():
+			return *departures[i].StopsAway < *departures[j].StopsAway
+		}
+		return a.Before(c)
+	})
+	if len(departures) > limit {
+		departures = departures[:limit]
+	}
+	if departures == nil {
+		departures = []Departure{}
+	}
+	return departures
+}
+
+// 時刻表の便の情報を設定する。系統名は系統データ、なければ時刻表のdc:titleを使う
+func (d *Departure) setScheduled(scheduled timedDeparture, patterns map[string]*routePattern) {
+	at := scheduled.at
+	d.ScheduledTime = &at
+	d.RouteTitle = scheduled.title
+	if pattern := patterns[scheduled.pattern]; pattern != nil {
+		d.RouteTitle = pattern.title
+	}
+	d.Destination = scheduled.destination
+	d.DestinationBusstopPole = scheduled.destinationPole
+	d.BusroutePattern = scheduled.pattern
+	d.Busroute = scheduled.busroute
+	d.Calendar = scheduled.calendar
+}
+
+// 発車の見込み時刻 (推定時刻、なければ時刻表の時刻)。どちらもない場合はゼロ値
+func (d Departure) expectedTime() time.Time {
+	switch {
+	case d.EstimatedTime != nil:
+		return *d.EstimatedTime
+	case d.ScheduledTime != nil:
+		return *d.ScheduledTime
+	}
+	return time.Time{}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// 標柱の発車案内を返すハンドラー
+func GetBusstopPoleDepartures(w http.ResponseWriter, r *http.Request) {
+	sameAs := departuresPoleParam(r)
+	if sameAs == "" {
+		if strings.HasPrefix(r.URL.Path, "/busstoppole/") {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "sameAs parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// 名称の言語を取得 (langパラメータまたはAccept-Language)
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"), defaultDepartureLimit, maxDepartureLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 基準時刻 (省略時は現在時刻)。指定した場合は時刻表だけで答える
+	now := time.Now()
+	realtime := true
+	if value := r.URL.Query().Get("time"); value != "" {
+		if now, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "invalid time parameter", http.StatusBadRequest)
+			return
+		}
+		realtime = false
+	}
+	now = now.In(japanTime)
+
+	static := getStaticData()
+	operator, busstop := static.lookupBusstopPole(sameAs)
+	if operator == nil {
+		http.Error(w, fmt.Sprintf("Busstop pole not found: %s", sameAs), http.StatusNotFound)
+		return
+	}
+	timetables := static.poleTimetables(operator.ID)
+	if timetables == nil && !operator.Realtime {
+		http.Error(w, fmt.Sprintf("Data not found for operator: %s", operator.ID), http.StatusNotFound)
+		return
+	}
+
+	board := newDepartureBoard(sameAs, now, timetables, static.routePatterns(operator.ID), static.busstopPoleSummaries(operator.ID))
+
+	// 走行中の車両は /location/busvehicle と同じキャッシュから取得する
+	var snapshots []*odptBusSnapshot
+	if realtime && operator.Realtime {
+		snapshot, upstreamErr := sharedBusCache.get(r.Context(), operator.ID, url.Values{})
+		if upstreamErr != nil {
+			// 車両情報が取得できない場合も時刻表の発車案内は返す
+			log.Printf("Error fetching buses for departures: %s", upstreamErr.message)
+		} else {
+			snapshots = append(snapshots, snapshot)
+			for _, bus := range convertODPTBuses(snapshot.buses) {
+				board.addBus(bus)
+			}
+		}
+	}
+	board.addScheduled()
+
+	departures := board.result(limit)
+	summaries := static.busstopPoleSummaries(operator.ID)
+	for i := range departures {
+		departures[i] = departures[i].localized(lang, summaries)
+	}
+
+	day := timetables.serviceDay(sameAs, now)
+	response := BusstopPoleDepartures{
+		BusstopPole: *busstop.localized(lang),
+		ServiceDate: day.Format("2006-01-02"),
+		Calendar:    serviceDayCalendar(day),
+		Departures:  departures,
+	}
+
+	setSnapshotHeaders(w, snapshots)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	logResult(r.Context(), []string{operator.ID}, len(response.Departures))
+}
+
+// /busstoppole/{sameAs}/departures のsameAs。パスにない場合はsameAsパラメータ (Vercelのrewrites) を使う
+func departuresPoleParam(r *http.Request) string {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/busstoppole/"); ok {
+		sameAs, ok := strings.CutSuffix(rest, "/departures")
+		if !ok || strings.Contains(sameAs, "/") {
+			return ""
+		}
+		return sameAs
+	}
+	return r.URL.Query().Get("sameAs")
+}
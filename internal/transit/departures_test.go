@@ -0,0 +1,268 @@
+package transit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPattern      = "odpt.BusroutePattern:Toei.RH01.8403.1"
+	testOtherPattern = "odpt.BusroutePattern:Toei.To01.1.1"
+	testPoleA        = "odpt.BusstopPole:Toei.ShibuyaStation.636.6"
+	testPoleB        = "odpt.BusstopPole:Toei.Nishiazabu.1736.2"
+	testPoleC        = "odpt.BusstopPole:Toei.RoppongiHills.2480.1"
+)
+
+// 平日の時刻表。系統testPatternはA → B → Cの順に停まり、24:40にAを出る深夜便がある
+func newTestPoleTimetables(t *testing.T) poleTimetables {
+	t.Helper()
+	item := func(pattern, departureTime string, isMidnight bool) ODPTBusstopPoleTimetableObjectItem {
+		return ODPTBusstopPoleTimetableObjectItem{
+			DepartureTime:          departureTime,
+			BusroutePattern:        pattern,
+			IsMidnight:             isMidnight,
+			DestinationSign:        "六本木ヒルズ行",
+			DestinationBusstopPole: testPoleC,
+		}
+	}
+	return newPoleTimetables([]ODPTBusstopPoleTimetable{
+		{
+			SameAs:      "odpt.BusstopPoleTimetable:Toei.A.Weekday",
+			BusstopPole: testPoleA,
+			Calendar:    calendarWeekday,
+			BusstopPoleTimetableObject: []ODPTBusstopPoleTimetableObjectItem{
+				item(testPattern, "08:00", false),
+				item(testOtherPattern, "08:05", false),
+				item(testPattern, "08:30", false),
+				item(testPattern, "00:40", true),
+			},
+		},
+		{
+			SameAs:      "odpt.BusstopPoleTimetable:Toei.B.Weekday",
+			BusstopPole: testPoleB,
+			Calendar:    calendarWeekday,
+			BusstopPoleTimetableObject: []ODPTBusstopPoleTimetableObjectItem{
+				item(testPattern, "08:10", false),
+				item(testOtherPattern, "08:15", false),
+				item(testPattern, "08:40", false),
+				item(testPattern, "00:50", true),
+			},
+		},
+	})
+}
+
+func testRoutePatterns() map[string]*routePattern {
+	return newRoutePatterns([]ODPTBusroutePattern{{
+		SameAs: testPattern,
+		Title:  "ＲＨ０１",
+		BusstopPoleOrder: []ODPTBusstopPoleOrderItem{
+			{Index: 1, BusstopPole: testPoleA},
+			{Index: 2, BusstopPole: testPoleB},
+			{Index: 3, BusstopPole: testPoleC},
+		},
+	}})
+}
+
+// 2026年10月day日の日本時間 (16日は金曜)
+func jst(day, hour, min int) time.Time {
+	return time.Date(2026, 10, day, hour, min, 0, 0, japanTime)
+}
+
+func TestDepartureBoardMatchTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		bus       Bus
+		wantOK    bool
+		wantAt    time.Time
+		wantDelay time.Duration
+	}{
+		{
+			name:      "first trip of the day",
+			bus:       Bus{BusroutePattern: testPattern, FromBusstopPole: testPoleA, FromBusstopPoleTime: ptr(jst(16, 8, 2))},
+			wantOK:    true,
+			wantAt:    jst(16, 8, 10),
+			wantDelay: 2 * time.Minute,
+		},
+		{
+			name:      "second trip ignores other patterns",
+			bus:       Bus{BusroutePattern: testPattern, FromBusstopPole: testPoleA, FromBusstopPoleTime: ptr(jst(16, 8, 33))},
+			wantOK:    true,
+			wantAt:    jst(16, 8, 40),
+			wantDelay: 3 * time.Minute,
+		},
+		{
+			name:      "running early",
+			bus:       Bus{BusroutePattern: testPattern, FromBusstopPole: testPoleA, FromBusstopPoleTime: ptr(jst(16, 8, 28))},
+			wantOK:    true,
+			wantAt:    jst(16, 8, 40),
+			wantDelay: -2 * time.Minute,
+		},
+		{
+			// 土曜の0時台でも、金曜の運行日の深夜便と対応付ける
+			name:      "midnight trip of the previous service day",
+			bus:       Bus{BusroutePattern: testPattern, FromBusstopPole: testPoleA, FromBusstopPoleTime: ptr(jst(17, 0, 42))},
+			wantOK:    true,
+			wantAt:    jst(17, 0, 50),
+			wantDelay: 2 * time.Minute,
+		},
+		{
+			name: "no departure time",
+			bus:  Bus{BusroutePattern: testPattern, FromBusstopPole: testPoleA},
+		},
+		{
+			name: "no trip near the departure time",
+			bus:  Bus{BusroutePattern: testPattern, FromBusstopPole: testPoleA, FromBusstopPoleTime: ptr(jst(16, 12, 0))},
+		},
+		{
+			name: "pattern not in the timetable of this pole",
+			bus:  Bus{BusroutePattern: "odpt.BusroutePattern:Toei.Unknown.1.1", FromBusstopPole: testPoleA, FromBusstopPoleTime: ptr(jst(16, 8, 2))},
+		},
+		{
+			name: "no timetable at the last pole",
+			bus:  Bus{BusroutePattern: testPattern, FromBusstopPole: testPoleC, FromBusstopPoleTime: ptr(jst(16, 8, 20))},
+		},
+	}
+
+	timetables := newTestPoleTimetables(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			board := newDepartureBoard(testPoleB, jst(16, 8, 0), timetables, testRoutePatterns(), nil)
+			trip, delay, ok := board.matchTrip(tt.bus)
+			require.Equal(t, tt.wantOK, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, testPattern, trip.pattern)
+			assert.True(t, tt.wantAt.Equal(trip.at), "got %v", trip.at)
+			assert.Equal(t, tt.wantDelay, delay)
+		})
+	}
+}
+
+func TestDepartureBoardAddBus(t *testing.T) {
+	timetables := newTestPoleTimetables(t)
+	summaries := map[string]*BusstopPoleSummary{
+		testPoleC: {SameAs: testPoleC, Title: "六本木ヒルズ"},
+	}
+	board := newDepartureBoard(testPoleB, jst(16, 8, 3), timetables, testRoutePatterns(), summaries)
+
+	board.addBus(Bus{ID: "bus1", BusroutePattern: testPattern, FromBusstopPole: testPoleA, ToBusstopPole: testPoleB, FromBusstopPoleTime: ptr(jst(16, 8, 2))})
+	// 既にこの標柱を出た車両は加えない
+	board.addBus(Bus{ID: "bus2", BusroutePattern: testPattern, FromBusstopPole: testPoleB, FromBusstopPoleTime: ptr(jst(16, 8, 1))})
+	board.addScheduled()
+
+	departures := board.result(defaultDepartureLimit)
+	require.Len(t, departures, 4)
+
+	assert.Equal(t, "bus1", departures[0].Vehicle)
+	assert.True(t, departures[0].Realtime)
+	assert.True(t, jst(16, 8, 12).Equal(*departures[0].EstimatedTime))
+	assert.Equal(t, 120, *departures[0].Delay)
+	assert.Equal(t, 1, *departures[0].StopsAway)
+
+	// 車両と対応付けた08:10の便は時刻表の便として重ねない
+	assert.False(t, departures[1].Realtime)
+	assert.True(t, jst(16, 8, 15).Equal(*departures[1].ScheduledTime))
+	assert.True(t, jst(16, 8, 40).Equal(*departures[2].ScheduledTime))
+	assert.True(t, jst(17, 0, 50).Equal(*departures[3].ScheduledTime), "midnight trip of the same service day")
+}
+
+func TestPoleTimetablesServiceDay(t *testing.T) {
+	tests := []struct {
+		name string
+		pole string
+		now  time.Time
+		want time.Time
+	}{
+		{name: "daytime", pole: testPoleB, now: jst(16, 8, 0), want: jst(16, 0, 0)},
+		{name: "before the last midnight trip", pole: testPoleB, now: jst(17, 0, 30), want: jst(16, 0, 0)},
+		{name: "at the last midnight trip", pole: testPoleB, now: jst(17, 0, 50), want: jst(16, 0, 0)},
+		{name: "after the last midnight trip", pole: testPoleB, now: jst(17, 1, 0), want: jst(17, 0, 0)},
+		{name: "previous day without midnight trips", pole: testPoleB, now: jst(18, 0, 30), want: jst(18, 0, 0)},
+		{name: "pole without timetable", pole: testPoleC, now: jst(17, 0, 30), want: jst(17, 0, 0)},
+		{name: "utc time", pole: testPoleB, now: jst(17, 0, 30).UTC(), want: jst(16, 0, 0)},
+	}
+
+	timetables := newTestPoleTimetables(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := timetables.serviceDay(tt.pole, tt.now)
+			assert.True(t, tt.want.Equal(got), "got %v", got)
+		})
+	}
+}
+
+func TestDepartureLocalized(t *testing.T) {
+	summaries := map[string]*BusstopPoleSummary{
+		testPoleC: {
+			SameAs:   testPoleC,
+			Title:    "六本木ヒルズ",
+			titleMap: map[string]string{"ja": "六本木ヒルズ", "en": "Roppongi Hills"},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		lang            *languagePreference
+		departure       Departure
+		wantDestination string
+		wantTitles      map[string]string
+	}{
+		{
+			name:            "default language keeps the destination sign",
+			departure:       Departure{Destination: "六本木ヒルズ行", DestinationBusstopPole: testPoleC},
+			wantDestination: "六本木ヒルズ行",
+		},
+		{
+			name:            "japanese keeps the destination sign",
+			lang:            &languagePreference{tags: []string{"ja"}},
+			departure:       Departure{Destination: "六本木ヒルズ行", DestinationBusstopPole: testPoleC},
+			wantDestination: "六本木ヒルズ行",
+		},
+		{
+			name:            "english uses the destination pole",
+			lang:            &languagePreference{tags: []string{"en"}},
+			departure:       Departure{Destination: "六本木ヒルズ行", DestinationBusstopPole: testPoleC},
+			wantDestination: "Roppongi Hills",
+		},
+		{
+			name:            "all",
+			lang:            &languagePreference{tags: []string{"en"}, all: true},
+			departure:       Departure{Destination: "六本木ヒルズ行", DestinationBusstopPole: testPoleC},
+			wantDestination: "Roppongi Hills",
+			wantTitles:      map[string]string{"ja": "六本木ヒルズ行", "en": "Roppongi Hills"},
+		},
+		{
+			name:            "unknown destination pole",
+			lang:            &languagePreference{tags: []string{"en"}},
+			departure:       Departure{Destination: "渋谷駅前行", DestinationBusstopPole: testPoleA},
+			wantDestination: "渋谷駅前行",
+		},
+		{
+			name:            "destination pole without a sign",
+			lang:            &languagePreference{tags: []string{"ko"}},
+			departure:       Departure{DestinationBusstopPole: testPoleC},
+			wantDestination: "六本木ヒルズ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.departure.RouteTitle = "ＲＨ０１"
+			got := tt.departure.localized(tt.lang, summaries)
+			assert.Equal(t, "ＲＨ０１", got.RouteTitle)
+			assert.Equal(t, tt.wantDestination, got.Destination)
+			assert.Equal(t, tt.wantTitles, got.DestinationTitles)
+		})
+	}
+
+	// 共有している標柱の多言語マップは書き換えない
+	assert.Equal(t, "六本木ヒルズ", summaries[testPoleC].titleMap["ja"])
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,214 @@
+package transit
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 地球の平均半径 (m)
+const earthRadius = 6371000.0
+
+// 2点間の大圏距離 (m) を返す
+func haversineDistance(lat1, long1, lat2, long2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (long2 - long1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// 2点間の初期方位角 (北を0度とした時計回りの度数) を返す
+func initialBearing(lat1, long1, lat2, long2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dLambda := (long2 - long1) * math.Pi / 180
+
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	bearing := math.Atan2(y, x) * 180 / math.Pi
+	return math.Mod(bearing+360, 360)
+}
+
+// boundingBox 経緯度の矩形範囲
+type boundingBox struct {
+	minLong float64
+	minLat  float64
+	maxLong float64
+	maxLat  float64
+}
+
+// bboxパラメータ (minLon,minLat,maxLon,maxLat) を解析する。未指定の場合はnilを返す
+func parseBoundingBox(value string) (*boundingBox, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, errors.New("invalid bbox parameter")
+		}
+		values[i] = v
+	}
+
+	bbox := &boundingBox{minLong: values[0], minLat: values[1], maxLong: values[2], maxLat: values[3]}
+	if bbox.minLong > bbox.maxLong || bbox.minLat > bbox.maxLat {
+		return nil, errors.New("invalid bbox parameter: min must not exceed max")
+	}
+	if bbox.minLat < -90 || bbox.maxLat > 90 || bbox.minLong < -180 || bbox.maxLong > 180 {
+		return nil, errors.New("invalid bbox parameter: out of range")
+	}
+
+	return bbox, nil
+}
+
+func (b *boundingBox) contains(lat, long float64) bool {
+	return lat >= b.minLat && lat <= b.maxLat && long >= b.minLong && long <= b.maxLong
+}
+
+// polyline 系統の経路形状 (GeoJSON LineString) と各頂点までの累積距離
+type polyline struct {
+	points     [][2]float64 // [経度, 緯度]
+	cumulative []float64    // 始点から各頂点までの距離 (m)
+}
+
+// GeoJSONのregionからpolylineを構築する
+// LineStringとMultiLineString(連結して扱う)に対応し、それ以外はnilを返す
+func parseRegionLine(region json.RawMessage) *polyline {
+	if len(region) == 0 {
+		return nil
+	}
+
+	var geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	if err := json.Unmarshal(region, &geometry); err != nil {
+		return nil
+	}
+
+	var points [][2]float64
+	switch geometry.Type {
+	case "LineString":
+		var coords [][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &coords); err != nil {
+			return nil
+		}
+		points = appendCoordinates(points, coords)
+	case "MultiLineString":
+		var lines [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &lines); err != nil {
+			return nil
+		}
+		for _, coords := range lines {
+			points = appendCoordinates(points, coords)
+		}
+	default:
+		return nil
+	}
+
+	return newPolyline(points)
+}
+
+func appendCoordinates(points [][2]float64, coords [][]float64) [][2]float64 {
+	for _, c := range coords {
+		if len(c) < 2 {
+			continue
+		}
+		points = append(points, [2]float64{c[0], c[1]})
+	}
+	return points
+}
+
+func newPolyline(points [][2]float64) *polyline {
+	if len(points) < 2 {
+		return nil
+	}
+
+	cumulative := make([]float64, len(points))
+	for i := 1; i < len(points); i++ {
+		prev, cur := points[i-1], points[i]
+		cumulative[i] = cumulative[i-1] + haversineDistance(prev[1], prev[0], cur[1], cur[0])
+	}
+
+	return &polyline{points: points, cumulative: cumulative}
+}
+
+// 経路全体の長さ (m)
+func (p *polyline) length() float64 {
+	return p.cumulative[len(p.cumulative)-1]
+}
+
+// 座標を経路上に射影し、始点からの距離と経路までの距離 (m) を返す
+// minAlongより手前の区間は対象外とする (環状系統で折り返し側に射影されないようにするため)
+func (p *polyline) project(lat, long, minAlong float64) (along, offset float64) {
+	offset = math.Inf(1)
+	along = minAlong
+
+	for i := 1; i < len(p.points); i++ {
+		if p.cumulative[i] < minAlong {
+			continue
+		}
+
+		a, b := p.points[i-1], p.points[i]
+
+		// 区間の始点を原点とした局所平面座標 (m) に変換
+		scale := math.Cos(a[1] * math.Pi / 180)
+		bx := (b[0] - a[0]) * scale
+		by := b[1] - a[1]
+		px := (long - a[0]) * scale
+		py := lat - a[1]
+
+		t := 0.0
+		if lenSq := bx*bx + by*by; lenSq > 0 {
+			t = math.Max(0, math.Min(1, (px*bx+py*by)/lenSq))
+		}
+
+		segmentAlong := p.cumulative[i-1] + t*(p.cumulative[i]-p.cumulative[i-1])
+		if segmentAlong < minAlong {
+			continue
+		}
+
+		projLong := a[0] + (b[0]-a[0])*t
+		projLat := a[1] + (b[1]-a[1])*t
+		if d := haversineDistance(lat, long, projLat, projLong); d < offset {
+			offset = d
+			along = segmentAlong
+		}
+	}
+
+	return along, offset
+}
+
+// 始点からalong (m) の地点の座標と進行方向の方位角を返す
+func (p *polyline) pointAt(along float64) (lat, long, bearing float64) {
+	along = math.Max(0, math.Min(along, p.length()))
+
+	i := 1
+	for i < len(p.points)-1 && p.cumulative[i] < along {
+		i++
+	}
+
+	a, b := p.points[i-1], p.points[i]
+	t := 0.0
+	if segment := p.cumulative[i] - p.cumulative[i-1]; segment > 0 {
+		t = (along - p.cumulative[i-1]) / segment
+	}
+
+	lat = a[1] + (b[1]-a[1])*t
+	long = a[0] + (b[0]-a[0])*t
+	bearing = initialBearing(a[1], a[0], b[1], b[0])
+	return lat, long, bearing
+}
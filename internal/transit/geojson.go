@@ -0,0 +1,128 @@
+package transit
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// GeoJSONのメディアタイプ
+const geoJSONContentType = "application/geo+json"
+
+// geoJSONFeatureCollection GeoJSONのFeatureCollection
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// geoJSONFeature GeoJSONのFeature。位置が分からない場合のgeometryはnull
+type geoJSONFeature struct {
+	Type       string      `json:"type"`
+	ID         string      `json:"id,omitempty"`
+	Geometry   interface{} `json:"geometry"`
+	Properties interface{} `json:"properties"`
+}
+
+// geoJSONPoint GeoJSONのPoint ([経度, 緯度])
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+func newGeoJSONPoint(lat, long float64) *geoJSONPoint {
+	return &geoJSONPoint{Type: "Point", Coordinates: [2]float64{long, lat}}
+}
+
+// format=geojson またはAcceptヘッダーでGeoJSONが要求されているか判定する
+func wantsGeoJSON(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("format") {
+	case "geojson":
+		return true, nil
+	case "json":
+		return false, nil
+	case "":
+	default:
+		return false, errors.New("invalid format parameter")
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == geoJSONContentType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FeatureCollectionをGeoJSONとして書き出す
+func writeGeoJSON(w http.ResponseWriter, features []geoJSONFeature) error {
+	w.Header().Set("Content-Type", geoJSONContentType)
+	return json.NewEncoder(w).Encode(geoJSONFeatureCollection{Type: "FeatureCollection", Features: features})
+}
+
+// バス停をPointのFeatureに変換する
+func busstopFeatures(busstops []BusstopPole) []geoJSONFeature {
+	features := make([]geoJSONFeature, 0, len(busstops))
+	for _, busstop := range busstops {
+		features = append(features, geoJSONFeature{
+			Type:       "Feature",
+			ID:         busstop.SameAs,
+			Geometry:   newGeoJSONPoint(busstop.Lat, busstop.Long),
+			Properties: busstop,
+		})
+	}
+	return features
+}
+
+// 親のバス停を重心のPointのFeatureに変換する
+func parentBusstopFeatures(busstops []Busstop) []geoJSONFeature {
+	features := make([]geoJSONFeature, 0, len(busstops))
+	for _, busstop := range busstops {
+		features = append(features, geoJSONFeature{
+			Type:       "Feature",
+			ID:         busstop.ID,
+			Geometry:   newGeoJSONPoint(busstop.Lat, busstop.Long),
+			Properties: busstop,
+		})
+	}
+	return features
+}
+
+// 車両を推定位置のPointのFeatureに変換する。推定位置がない車両のgeometryはnull
+func busFeatures(buses []Bus) []geoJSONFeature {
+	features := make([]geoJSONFeature, 0, len(buses))
+	for _, bus := range buses {
+		feature := geoJSONFeature{
+			Type:       "Feature",
+			ID:         bus.ID,
+			Properties: bus,
+		}
+		if bus.EstimatedPosition != nil {
+			feature.Geometry = newGeoJSONPoint(bus.EstimatedPosition.Lat, bus.EstimatedPosition.Long)
+		}
+		features = append(features, feature)
+	}
+	return features
+}
+
+// 系統をregion (LineString) をgeometryとするFeatureに変換する
+func busroutePatternFeatures(patterns []BusroutePattern) []geoJSONFeature {
+	features := make([]geoJSONFeature, 0, len(patterns))
+	for _, pattern := range patterns {
+		feature := geoJSONFeature{
+			Type: "Feature",
+			ID:   pattern.SameAs,
+		}
+		if len(pattern.Region) > 0 {
+			feature.Geometry = pattern.Region
+		}
+
+		// geometryと重複するregionはpropertiesから除く
+		pattern.Region = nil
+		feature.Properties = pattern
+
+		features = append(features, feature)
+	}
+	return features
+}
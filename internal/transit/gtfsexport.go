@@ -0,0 +1,299 @@
+package transit
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GTFSのタイムゾーン
+const gtfsTimezone = "Asia/Tokyo"
+
+// GTFSのroute_type (バス)
+const gtfsRouteTypeBus = 3
+
+// ODPTのカレンダーからGTFSのcalendar.txtの曜日 (月〜日) への対応
+var gtfsCalendarDays = map[string][7]bool{
+	"odpt.Calendar:Weekday":         {true, true, true, true, true, false, false},
+	"odpt.Calendar:Saturday":        {false, false, false, false, false, true, false},
+	"odpt.Calendar:Holiday":         {false, false, false, false, false, false, true},
+	"odpt.Calendar:SundayHoliday":   {false, false, false, false, false, false, true},
+	"odpt.Calendar:SaturdayHoliday": {false, false, false, false, false, true, true},
+	"odpt.Calendar:Everyday":        {true, true, true, true, true, true, true},
+}
+
+// gtfsFile GTFSのzipに書き出す1つのCSVファイル
+type gtfsFile struct {
+	name   string
+	header []string
+	rows   [][]string
+}
+
+func (f *gtfsFile) add(row ...string) {
+	f.rows = append(f.rows, row)
+}
+
+// gtfs-exportサブコマンド: assetsのODPTデータからGTFS静的データのzipを生成する
+func RunGTFSExport(args []string) error {
+	flags := flag.NewFlagSet("gtfs-export", flag.ContinueOnError)
+	operatorFlag := flags.String("operator", "", "事業者のID (カンマ区切りで複数指定可, 例: odpt.Operator:Toei)")
+	output := flags.String("o", "gtfs.zip", "出力するzipファイルのパス")
+	agencyURL := flags.String("agency-url", "https://www.odpt.org/", "agency.txtのagency_url")
+	validDays := flags.Int("valid-days", 365, "calendar.txtとcalendar_dates.txtの有効期間 (今日からの日数)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	operators, err := parseOperators(*operatorFlag)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	files, err := buildGTFSFeed(operators, *agencyURL, start, *validDays)
+	if err != nil {
+		return err
+	}
+
+	if err := writeGTFSZip(*output, files); err != nil {
+		return err
+	}
+
+	log.Printf("Wrote GTFS feed for %s to %s in %v", strings.Join(operators, ","), *output, time.Since(start))
+	return nil
+}
+
+// 事業者ごとのバス停・系統・時刻表データからGTFSの各ファイルを組み立てる
+// stop_idはバス停のsameAs、route_idは系統のsameAs、trip_idは時刻表のsameAsとし、
+// /location/busvehicle および GTFS-Realtime フィードのIDと一致させる
+func buildGTFSFeed(operators []string, agencyURL string, today time.Time, validDays int) ([]*gtfsFile, error) {
+	agency := &gtfsFile{name: "agency.txt", header: []string{"agency_id", "agency_name", "agency_url", "agency_timezone", "agency_lang"}}
+	stops := &gtfsFile{name: "stops.txt", header: []string{"stop_id", "stop_name", "stop_lat", "stop_lon"}}
+	routes := &gtfsFile{name: "routes.txt", header: []string{"route_id", "agency_id", "route_short_name", "route_long_name", "route_type"}}
+	shapes := &gtfsFile{name: "shapes.txt", header: []string{"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence", "shape_dist_traveled"}}
+	calendar := &gtfsFile{name: "calendar.txt", header: []string{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"}}
+	trips := &gtfsFile{name: "trips.txt", header: []string{"route_id", "service_id", "trip_id", "trip_headsign", "shape_id"}}
+	stopTimes := &gtfsFile{name: "stop_times.txt", header: []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence", "pickup_type", "drop_off_type"}}
+
+	services := make(map[string]bool)
+	for _, operator := range operators {
+		agency.add(operator, lookupOperator(operator).Title["ja"], agencyURL, gtfsTimezone, "ja")
+
+		// stops.txt
+		odptBusstops, err := loadODPTBusstopPoles(operator)
+		if err != nil {
+			return nil, fmt.Errorf("loading busstop data for %s: %w", operator, err)
+		}
+		knownStops := make(map[string]bool, len(odptBusstops))
+		for _, odptBusstop := range odptBusstops {
+			if odptBusstop.SameAs == "" || knownStops[odptBusstop.SameAs] {
+				continue
+			}
+			knownStops[odptBusstop.SameAs] = true
+			stops.add(odptBusstop.SameAs, busstopTitle(odptBusstop), formatCoordinate(odptBusstop.Lat), formatCoordinate(odptBusstop.Long))
+		}
+
+		// routes.txt, shapes.txt
+		odptPatterns, err := loadODPTBusroutePatterns(operator)
+		if err != nil {
+			return nil, fmt.Errorf("loading busroute pattern data for %s: %w", operator, err)
+		}
+		knownShapes := make(map[string]bool, len(odptPatterns))
+		for _, odptPattern := range odptPatterns {
+			routes.add(odptPattern.SameAs, operator, odptPattern.Title, odptPattern.Note, strconv.Itoa(gtfsRouteTypeBus))
+
+			shape := parseRegionLine(odptPattern.Region)
+			if shape == nil {
+				continue
+			}
+			knownShapes[odptPattern.SameAs] = true
+			for i, point := range shape.points {
+				shapes.add(odptPattern.SameAs, formatCoordinate(point[1]), formatCoordinate(point[0]), strconv.Itoa(i+1), strconv.FormatFloat(shape.cumulative[i], 'f', 1, 64))
+			}
+		}
+
+		// trips.txt, stop_times.txt
+		odptTimetables, err := loadODPTBusTimetables(operator)
+		if err != nil {
+			return nil, fmt.Errorf("loading bus timetable data for %s: %w", operator, err)
+		}
+		for _, odptTimetable := range odptTimetables {
+			if len(odptTimetable.BusTimetableObject) == 0 {
+				continue
+			}
+
+			services[odptTimetable.Calendar] = true
+
+			shapeID := ""
+			if knownShapes[odptTimetable.BusroutePattern] {
+				shapeID = odptTimetable.BusroutePattern
+			}
+			headsign := odptTimetable.BusTimetableObject[0].DestinationSign
+			trips.add(odptTimetable.BusroutePattern, odptTimetable.Calendar, odptTimetable.SameAs, headsign, shapeID)
+
+			previous := -1
+			for _, item := range odptTimetable.BusTimetableObject {
+				if !knownStops[item.BusstopPole] {
+					log.Printf("Skipping unknown busstop %s in %s", item.BusstopPole, odptTimetable.SameAs)
+					continue
+				}
+
+				arrival, departure := item.ArrivalTime, item.DepartureTime
+				if arrival == "" {
+					arrival = departure
+				}
+				if departure == "" {
+					departure = arrival
+				}
+				arrivalSeconds, err := parseTimetableTime(arrival, item.IsMidnight, previous)
+				if err != nil {
+					return nil, fmt.Errorf("%s index %d: %w", odptTimetable.SameAs, item.Index, err)
+				}
+				departureSeconds, err := parseTimetableTime(departure, item.IsMidnight, arrivalSeconds)
+				if err != nil {
+					return nil, fmt.Errorf("%s index %d: %w", odptTimetable.SameAs, item.Index, err)
+				}
+				previous = departureSeconds
+
+				stopTimes.add(odptTimetable.SameAs, formatGTFSTime(arrivalSeconds), formatGTFSTime(departureSeconds), item.BusstopPole,
+					strconv.Itoa(item.Index), gtfsBoardingType(item.CanGetOn), gtfsBoardingType(item.CanGetOff))
+			}
+		}
+	}
+
+	// calendar.txt
+	serviceIDs := make([]string, 0, len(services))
+	for serviceID := range services {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Strings(serviceIDs)
+	startDate := today.Format("20060102")
+	endDate := today.AddDate(0, 0, validDays).Format("20060102")
+	for _, serviceID := range serviceIDs {
+		days, ok := gtfsCalendarDays[serviceID]
+		if !ok {
+			log.Printf("Unknown calendar %s, exporting as a service with no days", serviceID)
+		}
+		row := []string{serviceID}
+		for _, enabled := range days {
+			if enabled {
+				row = append(row, "1")
+			} else {
+				row = append(row, "0")
+			}
+		}
+		calendar.add(append(row, startDate, endDate)...)
+	}
+
+	// calendar_dates.txt
+	calendarDates := buildGTFSCalendarDates(serviceIDs, today, validDays)
+
+	return []*gtfsFile{agency, stops, routes, trips, stopTimes, calendar, calendarDates, shapes}, nil
+}
+
+// 平日の祝日は休日のダイヤで運行するため、calendar.txtの曜日との違いをcalendar_dates.txtの例外にする
+// (exception_type 1: 運行を追加、2: 運行を取り消し)
+func buildGTFSCalendarDates(serviceIDs []string, today time.Time, validDays int) *gtfsFile {
+	calendarDates := &gtfsFile{name: "calendar_dates.txt", header: []string{"service_id", "date", "exception_type"}}
+	y, m, d := today.Date()
+	for i := 0; i <= validDays; i++ {
+		date := time.Date(y, m, d+i, 0, 0, 0, 0, japanTime)
+		weekday := (int(date.Weekday()) + 6) % 7
+		slot := serviceDaySlot(date)
+		if slot == weekday {
+			continue
+		}
+		for _, serviceID := range serviceIDs {
+			days, ok := gtfsCalendarDays[serviceID]
+			if !ok || days[weekday] == days[slot] {
+				continue
+			}
+			exceptionType := "2"
+			if days[slot] {
+				exceptionType = "1"
+			}
+			calendarDates.add(serviceID, date.Format("20060102"), exceptionType)
+		}
+	}
+	return calendarDates
+}
+
+// 時刻表の "HH:MM" を0時からの秒数に変換する
+// 深夜便 (isMidnight) や前の停留所より早い時刻は翌日扱いとして24時間を加える
+func parseTimetableTime(value string, isMidnight bool, previous int) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	seconds := t.Hour()*3600 + t.Minute()*60
+	if isMidnight && seconds < 12*3600 {
+		seconds += 24 * 3600
+	}
+	for previous >= 0 && seconds < previous {
+		seconds += 24 * 3600
+	}
+	return seconds, nil
+}
+
+// 秒数をGTFSの "HH:MM:SS" (24時以降も可) に変換する
+func formatGTFSTime(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// ODPTの乗車・降車可否をGTFSのpickup_type / drop_off_typeに変換する (0: 可, 1: 不可)
+func gtfsBoardingType(allowed *bool) string {
+	if allowed != nil && !*allowed {
+		return "1"
+	}
+	return "0"
+}
+
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', 6, 64)
+}
+
+// GTFSの各ファイルをzipに書き出す。途中で失敗しても既存のファイルを壊さないよう一時ファイルから置き換える
+func writeGTFSZip(path string, files []*gtfsFile) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gtfs-*.zip")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	archive := zip.NewWriter(tmp)
+	for _, file := range files {
+		w, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		writer := csv.NewWriter(w)
+		if err := writer.Write(file.header); err != nil {
+			return err
+		}
+		if err := writer.WriteAll(file.rows); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,119 @@
+package transit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimetableTime(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		isMidnight bool
+		previous   int
+		want       int
+		wantErr    bool
+	}{
+		{name: "daytime", value: "08:15", previous: -1, want: 8*3600 + 15*60},
+		{name: "midnight trip after 24:00", value: "00:10", isMidnight: true, previous: -1, want: 24*3600 + 10*60},
+		{name: "midnight flag on an evening time", value: "23:50", isMidnight: true, previous: -1, want: 23*3600 + 50*60},
+		{name: "earlier than the previous stop rolls over", value: "00:05", previous: 23*3600 + 55*60, want: 24*3600 + 5*60},
+		{name: "previous stop already past 24:00", value: "00:20", isMidnight: true, previous: 24*3600 + 10*60, want: 24*3600 + 20*60},
+		{name: "same as the previous stop", value: "12:00", previous: 12 * 3600, want: 12 * 3600},
+		{name: "invalid", value: "8:5x", previous: -1, wantErr: true},
+		{name: "hour beyond 23 is rejected", value: "25:10", previous: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimetableTime(tt.value, tt.isMidnight, tt.previous)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, got, parseGTFSSeconds(t, formatGTFSTime(got)))
+		})
+	}
+}
+
+// formatGTFSTimeの結果を秒数に戻す
+func parseGTFSSeconds(t *testing.T, value string) int {
+	t.Helper()
+	var h, m, s int
+	_, err := fmt.Sscanf(value, "%d:%d:%d", &h, &m, &s)
+	require.NoError(t, err)
+	return h*3600 + m*60 + s
+}
+
+func TestBuildGTFSCalendarDates(t *testing.T) {
+	services := []string{
+		"odpt.Calendar:Everyday",
+		"odpt.Calendar:Holiday",
+		"odpt.Calendar:Saturday",
+		"odpt.Calendar:SaturdayHoliday",
+		"odpt.Calendar:Weekday",
+		"odpt.Calendar:Specific.Unknown",
+	}
+
+	tests := []struct {
+		name      string
+		today     time.Time
+		validDays int
+		want      [][]string
+	}{
+		{
+			name:      "weekday holiday",
+			today:     time.Date(2026, 11, 2, 0, 0, 0, 0, japanTime), // 11/3 (火) 文化の日
+			validDays: 2,
+			want: [][]string{
+				{"odpt.Calendar:Holiday", "20261103", "1"},
+				{"odpt.Calendar:SaturdayHoliday", "20261103", "1"},
+				{"odpt.Calendar:Weekday", "20261103", "2"},
+			},
+		},
+		{
+			name:      "holiday on saturday",
+			today:     time.Date(2028, 1, 1, 0, 0, 0, 0, japanTime), // 1/1 (土) 元日
+			validDays: 0,
+			want: [][]string{
+				{"odpt.Calendar:Holiday", "20280101", "1"},
+				{"odpt.Calendar:Saturday", "20280101", "2"},
+			},
+		},
+		{
+			name:      "sunday holiday and substitute holiday",
+			today:     time.Date(2026, 5, 3, 0, 0, 0, 0, japanTime), // 5/3 (日) 憲法記念日、5/6 (水) 振替休日
+			validDays: 4,
+			want: [][]string{
+				{"odpt.Calendar:Holiday", "20260504", "1"},
+				{"odpt.Calendar:SaturdayHoliday", "20260504", "1"},
+				{"odpt.Calendar:Weekday", "20260504", "2"},
+				{"odpt.Calendar:Holiday", "20260505", "1"},
+				{"odpt.Calendar:SaturdayHoliday", "20260505", "1"},
+				{"odpt.Calendar:Weekday", "20260505", "2"},
+				{"odpt.Calendar:Holiday", "20260506", "1"},
+				{"odpt.Calendar:SaturdayHoliday", "20260506", "1"},
+				{"odpt.Calendar:Weekday", "20260506", "2"},
+			},
+		},
+		{
+			name:      "no holidays",
+			today:     time.Date(2026, 6, 1, 0, 0, 0, 0, japanTime),
+			validDays: 14,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := buildGTFSCalendarDates(services, tt.today, tt.validDays)
+			assert.Equal(t, "calendar_dates.txt", file.name)
+			assert.Equal(t, tt.want, file.rows)
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package transit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GTFS-Realtimeのバージョン
+const gtfsRealtimeVersion = "2.0"
+
+// GTFS-Realtime VehiclePosition.VehicleStopStatus
+const (
+	vehicleStopStatusIncomingAt  = 0
+	vehicleStopStatusStoppedAt   = 1
+	vehicleStopStatusInTransitTo = 2
+)
+
+// pbMessage Protocol Buffersのメッセージ。バイナリ形式とテキスト形式の両方に書き出せる
+type pbMessage struct {
+	fields []pbField
+}
+
+type pbFieldKind int
+
+const (
+	pbKindString pbFieldKind = iota
+	pbKindUint
+	pbKindEnum
+	pbKindFloat
+	pbKindBool
+	pbKindMessage
+)
+
+type pbField struct {
+	number  int
+	name    string
+	kind    pbFieldKind
+	str     string  // pbKindString, pbKindEnumの列挙子名
+	num     uint64  // pbKindUint, pbKindEnum, pbKindBool
+	float   float32 // pbKindFloat
+	message *pbMessage
+}
+
+func (m *pbMessage) addString(number int, name, value string) {
+	if value == "" {
+		return
+	}
+	m.fields = append(m.fields, pbField{number: number, name: name, kind: pbKindString, str: value})
+}
+
+func (m *pbMessage) addUint(number int, name string, value uint64) {
+	m.fields = append(m.fields, pbField{number: number, name: name, kind: pbKindUint, num: value})
+}
+
+func (m *pbMessage) addEnum(number int, name string, value uint64, label string) {
+	m.fields = append(m.fields, pbField{number: number, name: name, kind: pbKindEnum, num: value, str: label})
+}
+
+func (m *pbMessage) addFloat(number int, name string, value float32) {
+	m.fields = append(m.fields, pbField{number: number, name: name, kind: pbKindFloat, float: value})
+}
+
+func (m *pbMessage) addBool(number int, name string, value bool) {
+	var num uint64
+	if value {
+		num = 1
+	}
+	m.fields = append(m.fields, pbField{number: number, name: name, kind: pbKindBool, num: num})
+}
+
+func (m *pbMessage) addMessage(number int, name string) *pbMessage {
+	child := &pbMessage{}
+	m.fields = append(m.fields, pbField{number: number, name: name, kind: pbKindMessage, message: child})
+	return child
+}
+
+// Protocol Buffersのバイナリ形式に変換する
+func (m *pbMessage) marshal() []byte {
+	var buf []byte
+	for _, f := range m.fields {
+		switch f.kind {
+		case pbKindString:
+			buf = binary.AppendUvarint(buf, uint64(f.number)<<3|2)
+			buf = binary.AppendUvarint(buf, uint64(len(f.str)))
+			buf = append(buf, f.str...)
+		case pbKindUint, pbKindEnum, pbKindBool:
+			buf = binary.AppendUvarint(buf, uint64(f.number)<<3)
+			buf = binary.AppendUvarint(buf, f.num)
+		case pbKindFloat:
+			buf = binary.AppendUvarint(buf, uint64(f.number)<<3|5)
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(f.float))
+		case pbKindMessage:
+			child := f.message.marshal()
+			buf = binary.AppendUvarint(buf, uint64(f.number)<<3|2)
+			buf = binary.AppendUvarint(buf, uint64(len(child)))
+			buf = append(buf, child...)
+		}
+	}
+	return buf
+}
+
+// Protocol Buffersのテキスト形式に変換する (デバッグ用)
+func (m *pbMessage) text() string {
+	var sb strings.Builder
+	m.writeText(&sb, 0)
+	return sb.String()
+}
+
+func (m *pbMessage) writeText(sb *strings.Builder, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, f := range m.fields {
+		switch f.kind {
+		case pbKindString:
+			fmt.Fprintf(sb, "%s%s: %s\n", indent, f.name, strconv.Quote(f.str))
+		case pbKindUint:
+			fmt.Fprintf(sb, "%s%s: %d\n", indent, f.name, f.num)
+		case pbKindEnum:
+			fmt.Fprintf(sb, "%s%s: %s\n", indent, f.name, f.str)
+		case pbKindBool:
+			fmt.Fprintf(sb, "%s%s: %t\n", indent, f.name, f.num == 1)
+		case pbKindFloat:
+			fmt.Fprintf(sb, "%s%s: %s\n", indent, f.name, strconv.FormatFloat(float64(f.float), 'g', -1, 32))
+		case pbKindMessage:
+			fmt.Fprintf(sb, "%s%s {\n", indent, f.name)
+			f.message.writeText(sb, depth+1)
+			fmt.Fprintf(sb, "%s}\n", indent)
+		}
+	}
+}
+
+// 車両情報からGTFS-RealtimeのFeedMessageを組み立てる
+// trip_idはbusTimetable、route_idはbusroutePattern、stop_idはバス停のsameAsに対応する
+func buildVehiclePositionsFeed(buses []Bus, patterns map[string]*routePattern, now time.Time) *pbMessage {
+	feed := &pbMessage{}
+
+	header := feed.addMessage(1, "header")
+	header.addString(1, "gtfs_realtime_version", gtfsRealtimeVersion)
+	header.addEnum(2, "incrementality", 0, "FULL_DATASET")
+	header.addUint(3, "timestamp", uint64(now.Unix()))
+
+	for _, bus := range buses {
+		entity := feed.addMessage(2, "entity")
+		entity.addString(1, "id", bus.ID)
+
+		vehicle := entity.addMessage(4, "vehicle")
+
+		if bus.BusTimetable != "" || bus.BusroutePattern != "" {
+			trip := vehicle.addMessage(1, "trip")
+			trip.addString(1, "trip_id", bus.BusTimetable)
+			trip.addString(5, "route_id", bus.BusroutePattern)
+		}
+
+		if position := bus.EstimatedPosition; position != nil {
+			pos := vehicle.addMessage(2, "position")
+			pos.addFloat(1, "latitude", float32(position.Lat))
+			pos.addFloat(2, "longitude", float32(position.Long))
+			// bearingは任意のフィールド。0は北を意味するため、進行方向がわからない場合は出力しない
+			if position.Bearing != nil {
+				pos.addFloat(3, "bearing", float32(*position.Bearing))
+			}
+		}
+
+		// 次のバス停へ向かっている場合はIN_TRANSIT_TO、終着などで次のバス停がない場合は直近のバス停にSTOPPED_AT
+		stopID, status, statusLabel := bus.ToBusstopPole, uint64(vehicleStopStatusInTransitTo), "IN_TRANSIT_TO"
+		if stopID == "" {
+			stopID, status, statusLabel = bus.FromBusstopPole, vehicleStopStatusStoppedAt, "STOPPED_AT"
+		}
+		if stopID != "" {
+			if pattern := patterns[bus.BusroutePattern]; pattern != nil {
+				if index, ok := pattern.poleIndex[stopID]; ok {
+					vehicle.addUint(3, "current_stop_sequence", uint64(index))
+				}
+			}
+			vehicle.addEnum(4, "current_status", status, statusLabel)
+		}
+
+		if !bus.Date.IsZero() {
+			vehicle.addUint(5, "timestamp", uint64(bus.Date.Unix()))
+		}
+		vehicle.addString(7, "stop_id", stopID)
+
+		if bus.BusNumber != "" {
+			descriptor := vehicle.addMessage(8, "vehicle")
+			descriptor.addString(1, "id", bus.BusNumber)
+			descriptor.addString(2, "label", bus.BusNumber)
+		}
+	}
+
+	return feed
+}
+
+// GTFS-Realtime VehiclePositionsフィードを返すハンドラー
+func GetGTFSRealtimeVehiclePositions(w http.ResponseWriter, r *http.Request) {
+	// クエリパラメータからoperatorを取得 (カンマ区切りで複数指定可)
+	operators, err := parseRealtimeOperators(r.URL.Query().Get("operator"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// オプションのフィルタパラメータを取得
+	filters := url.Values{}
+	for _, param := range busFilterParams {
+		if value := r.URL.Query().Get(param); value != "" {
+			filters.Add("odpt:"+param, value)
+		}
+	}
+
+	// 出力形式を取得 (text指定時はデバッグ用のテキスト形式)
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "text" && format != "protobuf" {
+		http.Error(w, "invalid format parameter", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	static := getStaticData()
+	buses := make([]Bus, 0)
+	patterns := make(map[string]*routePattern)
+	snapshots := make([]*odptBusSnapshot, 0, len(operators))
+	for _, operator := range operators {
+		// ODPT APIから車両情報を取得
+		snapshot, upstreamErr := sharedBusCache.get(r.Context(), operator, filters)
+		if upstreamErr != nil {
+			http.Error(w, upstreamErr.message, upstreamErr.status)
+			return
+		}
+		snapshots = append(snapshots, snapshot)
+
+		// 現在位置を推定
+		operatorBuses := convertODPTBuses(snapshot.buses)
+		operatorPatterns := static.routePatterns(operator)
+		enrichBuses(operatorBuses, static.busstopPoleSummaries(operator), operatorPatterns, nil, now)
+
+		for id, pattern := range operatorPatterns {
+			patterns[id] = pattern
+		}
+		buses = append(buses, operatorBuses...)
+	}
+
+	feed := buildVehiclePositionsFeed(buses, patterns, now)
+	setSnapshotHeaders(w, snapshots)
+	observeReturnedVehicles(buses)
+
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := w.Write([]byte(feed.text())); err != nil {
+			log.Printf("Error writing response: %v", err)
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		if _, err := w.Write(feed.marshal()); err != nil {
+			log.Printf("Error writing response: %v", err)
+			return
+		}
+	}
+
+	logResult(r.Context(), operators, len(buses))
+}
@@ -0,0 +1,107 @@
+package transit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPBMessageMarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(m *pbMessage)
+		want  []byte
+	}{
+		{
+			name:  "string",
+			build: func(m *pbMessage) { m.addString(1, "id", "testing") },
+			want:  []byte{0x0a, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'},
+		},
+		{
+			name:  "empty string is omitted",
+			build: func(m *pbMessage) { m.addString(1, "id", "") },
+			want:  nil,
+		},
+		{
+			name:  "multi-byte varint",
+			build: func(m *pbMessage) { m.addUint(1, "timestamp", 150) },
+			want:  []byte{0x08, 0x96, 0x01},
+		},
+		{
+			name:  "enum",
+			build: func(m *pbMessage) { m.addEnum(4, "current_status", vehicleStopStatusInTransitTo, "IN_TRANSIT_TO") },
+			want:  []byte{0x20, 0x02},
+		},
+		{
+			name:  "bool",
+			build: func(m *pbMessage) { m.addBool(3, "flag", true) },
+			want:  []byte{0x18, 0x01},
+		},
+		{
+			name:  "fixed32 float",
+			build: func(m *pbMessage) { m.addFloat(1, "latitude", 1) },
+			want:  []byte{0x0d, 0x00, 0x00, 0x80, 0x3f},
+		},
+		{
+			name:  "field number needing a two-byte tag",
+			build: func(m *pbMessage) { m.addUint(16, "field", 1) },
+			want:  []byte{0x80, 0x01, 0x01},
+		},
+		{
+			name: "nested message",
+			build: func(m *pbMessage) {
+				m.addMessage(3, "child").addUint(1, "value", 150)
+			},
+			want: []byte{0x1a, 0x03, 0x08, 0x96, 0x01},
+		},
+		{
+			name: "fields in insertion order",
+			build: func(m *pbMessage) {
+				m.addString(2, "b", "x")
+				m.addUint(1, "a", 1)
+			},
+			want: []byte{0x12, 0x01, 'x', 0x08, 0x01},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &pbMessage{}
+			tt.build(m)
+			assert.Equal(t, tt.want, m.marshal())
+		})
+	}
+}
+
+func TestBuildVehiclePositionsFeedBearing(t *testing.T) {
+	bearing := 72.5
+	tests := []struct {
+		name     string
+		position *VehiclePosition
+		want     string
+	}{
+		{
+			name:     "known bearing",
+			position: &VehiclePosition{Lat: 35.5, Long: 139.5, Bearing: &bearing},
+			want:     "bearing: 72.5",
+		},
+		{
+			name:     "unknown bearing is omitted",
+			position: &VehiclePosition{Lat: 35.5, Long: 139.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := Bus{ID: "bus1", FromBusstopPole: "pole1", EstimatedPosition: tt.position}
+			text := buildVehiclePositionsFeed([]Bus{bus}, nil, time.Unix(0, 0)).text()
+			assert.Contains(t, text, "latitude: 35.5")
+			if tt.want == "" {
+				assert.NotContains(t, text, "bearing")
+			} else {
+				assert.Contains(t, text, tt.want)
+			}
+		})
+	}
+}
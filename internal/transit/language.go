@@ -0,0 +1,238 @@
+package transit
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lang=all を指定すると、titleに加えてtitlesに多言語マップをすべて付ける
+const allLanguages = "all"
+
+// 用字を省略した中国語の言語タグと、ODPTのtitleで使われる言語タグの対応
+var chineseScripts = map[string]string{
+	"zh":    "zh-Hans",
+	"zh-cn": "zh-Hans",
+	"zh-sg": "zh-Hans",
+	"zh-tw": "zh-Hant",
+	"zh-hk": "zh-Hant",
+	"zh-mo": "zh-Hant",
+}
+
+// languagePreference 名称を返す言語の優先順位。nilの場合は日本語
+type languagePreference struct {
+	tags []string // 優先する順の言語タグ
+	all  bool     // 多言語マップをすべて返す
+}
+
+// langパラメータ (カンマ区切りの言語タグまたはall)、なければAccept-Languageヘッダーから名称の言語を決める
+func parseLanguage(r *http.Request) (*languagePreference, error) {
+	if value := r.URL.Query().Get("lang"); value != "" {
+		pref := &languagePreference{}
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			switch {
+			case tag == "":
+				continue
+			case strings.EqualFold(tag, allLanguages):
+				pref.all = true
+			case validLanguageTag(tag):
+				pref.tags = append(pref.tags, tag)
+			default:
+				return nil, errors.New("invalid lang parameter")
+			}
+		}
+		return pref, nil
+	}
+
+	tags := parseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return &languagePreference{tags: tags}, nil
+}
+
+// Accept-Languageヘッダーの言語タグを品質値の高い順に返す。*と品質値0、解釈できないものは除く
+func parseAcceptLanguage(header string) []string {
+	type weightedTag struct {
+		tag string
+		q   float64
+	}
+	var weighted []weightedTag
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || !validLanguageTag(tag) {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			continue
+		}
+		weighted = append(weighted, weightedTag{tag: tag, q: q})
+	}
+
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].q > weighted[j].q
+	})
+	tags := make([]string, 0, len(weighted))
+	for _, w := range weighted {
+		tags = append(tags, w.tag)
+	}
+	return tags
+}
+
+// 英数字とハイフンからなる言語タグか (例: en, zh-Hant, ja-Hrkt)
+func validLanguageTag(tag string) bool {
+	if tag == "" || len(tag) > 35 {
+		return false
+	}
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// 日本語の名称と多言語マップから、返す名称と (lang=allの場合は) 多言語マップを決める。lang=en,all のように併用できる
+// 指定された言語の名称がない場合は日本語の名称を返す
+func (p *languagePreference) localize(title string, titles map[string]string) (string, map[string]string) {
+	if p == nil {
+		return title, nil
+	}
+	localized := title
+	for _, tag := range p.tags {
+		if value, ok := lookupTitle(titles, tag); ok {
+			localized = value
+			break
+		}
+	}
+	if !p.all {
+		return localized, nil
+	}
+	if titles == nil && title != "" {
+		titles = map[string]string{"ja": title}
+	}
+	return localized, titles
+}
+
+// 言語タグに合う名称を引く。完全一致 (大文字小文字を区別しない)、中国語の用字、主言語の一致の順に探す
+func lookupTitle(titles map[string]string, tag string) (string, bool) {
+	if len(titles) == 0 {
+		return "", false
+	}
+	for key, value := range titles {
+		if strings.EqualFold(key, tag) && value != "" {
+			return value, true
+		}
+	}
+	if script, ok := chineseScripts[strings.ToLower(tag)]; ok {
+		if value := titles[script]; value != "" {
+			return value, true
+		}
+	}
+
+	// en-US → en のように主言語だけで探す。jaに対するja-Hrktのような別の表記は選ばない
+	base, _, _ := strings.Cut(tag, "-")
+	for key, value := range titles {
+		if strings.EqualFold(key, base) && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ODPTのtitle (文字列または多言語マップ) を言語タグごとの名称にする。jaは日本語の名称で補う
+func odptTitles(title interface{}, ja string) map[string]string {
+	titles := make(map[string]string)
+	if titleMap, ok := title.(map[string]interface{}); ok {
+		for lang, value := range titleMap {
+			if s, ok := value.(string); ok && s != "" {
+				titles[lang] = s
+			}
+		}
+	}
+	if ja != "" {
+		titles["ja"] = ja
+	}
+	if len(titles) == 0 {
+		return nil
+	}
+	return titles
+}
+
+// 標柱の名称を指定された言語にする
+func (b BusstopPole) localized(lang *languagePreference) BusstopPole {
+	b.Title, b.Titles = lang.localize(b.Title, b.titleMap)
+	return b
+}
+
+// バス停の概要の名称を指定された言語にする。共有しているデータは書き換えずに複製する
+func (s *BusstopPoleSummary) localized(lang *languagePreference) *BusstopPoleSummary {
+	if s == nil || lang == nil {
+		return s
+	}
+	summary := *s
+	summary.Title, summary.Titles = lang.localize(s.Title, s.titleMap)
+	return &summary
+}
+
+// 車両に展開したバス停の名称を指定された言語にする
+func (bus Bus) localized(lang *languagePreference) Bus {
+	bus.FromBusstopPoleDetail = bus.FromBusstopPoleDetail.localized(lang)
+	bus.ToBusstopPoleDetail = bus.ToBusstopPoleDetail.localized(lang)
+	bus.StartingBusstopPoleDetail = bus.StartingBusstopPoleDetail.localized(lang)
+	bus.TerminalBusstopPoleDetail = bus.TerminalBusstopPoleDetail.localized(lang)
+	return bus
+}
+
+// 発車案内の系統名と行先を指定された言語にする
+// 行先は行先の標柱の名称の多言語マップを使い、日本語は行先表示 (なければ標柱の名称) のままにする
+func (d Departure) localized(lang *languagePreference, summaries map[string]*BusstopPoleSummary) Departure {
+	d.RouteTitle, d.RouteTitles = lang.localize(d.RouteTitle, nil)
+
+	var titles map[string]string
+	if terminal := summaries[d.DestinationBusstopPole]; terminal != nil && len(terminal.titleMap) > 0 {
+		titles = make(map[string]string, len(terminal.titleMap))
+		for tag, title := range terminal.titleMap {
+			titles[tag] = title
+		}
+		if d.Destination == "" {
+			d.Destination = terminal.Title
+		}
+		titles["ja"] = d.Destination
+	}
+	d.Destination, d.DestinationTitles = lang.localize(d.Destination, titles)
+	return d
+}
+
+// 系統名を指定された言語にする。ODPTのデータに多言語の系統名はないため、名称は日本語のままで、lang=allでは日本語だけの多言語マップを付ける
+func (p BusroutePattern) localized(lang *languagePreference) BusroutePattern {
+	p.Title, p.Titles = lang.localize(p.Title, nil)
+	return p
+}
+
+// 親のバス停と子の標柱の名称を指定された言語にする
+func (b Busstop) localized(lang *languagePreference) Busstop {
+	if lang == nil {
+		return b
+	}
+	b.Title, b.Titles = lang.localize(b.Title, b.titleMap)
+	poles := make([]BusstopChildPole, len(b.Poles))
+	for i, pole := range b.Poles {
+		pole.Title, pole.Titles = lang.localize(pole.Title, pole.titleMap)
+		poles[i] = pole
+	}
+	b.Poles = poles
+	return b
+}
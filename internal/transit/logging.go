@@ -0,0 +1,219 @@
+package transit
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ログに出さないクエリパラメータ (ODPT APIのコンシューマーキーなど)
+var secretQueryParams = []string{"acl:consumerKey"}
+
+const redactedValue = "REDACTED"
+
+// 環境変数 LOG_FORMAT=json でJSON、それ以外はkey=value形式の構造化ログにする
+// 標準のlogパッケージの出力も同じ形式になる
+func SetupLogging() {
+	var handler slog.Handler
+	if os.Getenv("LOG_FORMAT") == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// 秘密のクエリパラメータの値を伏せたURL文字列を返す
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = redactQuery(u.Query()).Encode()
+	return redacted.String()
+}
+
+func redactQuery(q url.Values) url.Values {
+	redacted := make(url.Values, len(q))
+	for key, values := range q {
+		redacted[key] = values
+		for _, secret := range secretQueryParams {
+			if strings.EqualFold(key, secret) {
+				redacted[key] = []string{redactedValue}
+			}
+		}
+	}
+	return redacted
+}
+
+// net/httpのエラーに含まれるURLの秘密のクエリパラメータを伏せる
+func redactError(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	u, parseErr := url.Parse(urlErr.URL)
+	if parseErr != nil {
+		return urlErr.Err
+	}
+	return &url.Error{Op: urlErr.Op, URL: redactURL(u), Err: urlErr.Err}
+}
+
+// requestLog 1つのリクエストのログに付ける情報。ハンドラーや上流の呼び出しで埋める
+type requestLog struct {
+	mu               sync.Mutex
+	id               string
+	operator         string
+	records          int
+	upstreamRequests int
+	upstreamLatency  time.Duration
+}
+
+type requestLogKey struct{}
+
+func requestLogFrom(ctx context.Context) *requestLog {
+	if l, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return l
+	}
+	return nil
+}
+
+// リクエストIDを返す (リクエスト外の呼び出しでは空)
+func requestIDFrom(ctx context.Context) string {
+	if l := requestLogFrom(ctx); l != nil {
+		return l.id
+	}
+	return ""
+}
+
+// リクエストのログに事業者と返したレコード数を記録する
+func logResult(ctx context.Context, operators []string, records int) {
+	if l := requestLogFrom(ctx); l != nil {
+		l.mu.Lock()
+		l.operator, l.records = strings.Join(operators, ","), records
+		l.mu.Unlock()
+	}
+}
+
+// ODPT APIへのリクエストを1件ログに出し、呼び出し元のリクエストのログに上流の所要時間を加える
+// メトリクスにも件数と所要時間を記録する
+func logUpstreamRequest(ctx context.Context, u *url.URL, operator string, status int, latency time.Duration, records int, err error) {
+	observeUpstreamRequest(u.Path, status, latency, err)
+
+	if l := requestLogFrom(ctx); l != nil {
+		l.mu.Lock()
+		l.upstreamRequests++
+		l.upstreamLatency += latency
+		l.mu.Unlock()
+	}
+
+	attrs := []slog.Attr{
+		slog.String("request_id", requestIDFrom(ctx)),
+		slog.String("operator", operator),
+		slog.String("url", redactURL(u)),
+		slog.Int("status", status),
+		slog.Int64("upstream_latency_ms", latency.Milliseconds()),
+		slog.Int("records", records),
+	}
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", redactError(err).Error()))
+	}
+	slog.LogAttrs(ctx, level, "odpt request", attrs...)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// リクエストごとにリクエストIDを割り当て、終了時に構造化ログを1件出すミドルウェア
+// クライアントがX-Request-IDを送った場合はそれを、Vercel上ではX-Vercel-Idを使い、レスポンスのX-Request-IDで返す
+func LoggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = r.Header.Get("X-Vercel-Id")
+		}
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		l := &requestLog{id: id}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next(recorder, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l)))
+		duration := time.Since(start)
+		observeRequest(r, recorder.status, duration)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("query", redactQuery(r.URL.Query()).Encode()),
+			slog.Int("status", recorder.status),
+			slog.Int64("duration_ms", duration.Milliseconds()),
+		}
+		if l.operator != "" {
+			attrs = append(attrs, slog.String("operator", l.operator), slog.Int("records", l.records))
+		}
+		if l.upstreamRequests > 0 {
+			attrs = append(attrs, slog.Int("upstream_requests", l.upstreamRequests), slog.Int64("upstream_latency_ms", l.upstreamLatency.Milliseconds()))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	}
+}
+
+// statusRecorder レスポンスのステータスコードを記録する
+// ストリーミングとWebSocketのためにFlushとHijackを元のResponseWriterに委ねる
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	r.status, r.wroteHeader = http.StatusSwitchingProtocols, true
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
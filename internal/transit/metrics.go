@@ -0,0 +1,362 @@
+package transit
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 所要時間のヒストグラムの区切り (秒)。Prometheusのクライアントライブラリの既定値と同じ
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Prometheusのメトリクスの種類
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// metricFamily 同じ名前でラベルの値が異なる系列をまとめたもの
+// 外部のライブラリを使わず、/metrics でPrometheusのテキスト形式に書き出す
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // ヒストグラムの区切り (昇順)
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // ラベルの値を連結したキー → 系列
+}
+
+// metricSeries 1つのラベルの組み合わせの値
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter, gauge
+	counts      []uint64 // histogramの区切りごとの件数 (累積ではない)
+	sum         float64
+	count       uint64
+}
+
+// 登録順に /metrics に書き出すメトリクス
+var metricFamilies []*metricFamily
+
+func newMetric(name, help, kind string, buckets []float64, labels ...string) *metricFamily {
+	family := &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	// ラベルのないメトリクスは記録前から0として書き出す
+	if len(labels) == 0 {
+		family.seriesFor(nil)
+	}
+	metricFamilies = append(metricFamilies, family)
+	return family
+}
+
+func newCounter(name, help string, labels ...string) *metricFamily {
+	return newMetric(name, help, metricCounter, nil, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metricFamily {
+	return newMetric(name, help, metricGauge, nil, labels...)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return newMetric(name, help, metricHistogram, buckets, labels...)
+}
+
+// ラベルの値を連結して系列のキーにする
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// ラベルの値に対応する系列を返す。f.muを保持した状態で呼び出す
+func (f *metricFamily) seriesFor(labelValues []string) *metricSeries {
+	key := seriesKey(labelValues)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if f.kind == metricHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// counterに加算する
+func (f *metricFamily) add(value float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seriesFor(labelValues).value += value
+}
+
+// gaugeに値を設定する
+func (f *metricFamily) set(value float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seriesFor(labelValues).value = value
+}
+
+// gaugeのすべての系列を、fillでsetした値に置き換える (なくなった事業者などの系列を残さないため)
+// 新しい系列を作ってから入れ替えるため、同時に書き出しても空や作りかけの状態は見えない
+func (f *metricFamily) replace(fill func(set func(value float64, labelValues ...string))) {
+	series := make(map[string]*metricSeries)
+	fill(func(value float64, labelValues ...string) {
+		series[seriesKey(labelValues)] = &metricSeries{labelValues: labelValues, value: value}
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.series = series
+}
+
+// histogramに値を1件記録する
+func (f *metricFamily) observe(value float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.seriesFor(labelValues)
+	for i, bound := range f.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Prometheusのテキスト形式で書き出す
+func (f *metricFamily) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatMetricValue(s.value))
+			continue
+		}
+
+		// 区切りごとの件数はleラベルを付けて累積で書き出す
+		names := append(append([]string{}, f.labels...), "le")
+		values := append(append([]string{}, s.labelValues...), "")
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			values[len(values)-1] = formatMetricValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues), s.count)
+	}
+}
+
+// {name="value",...} の形式にする。ラベルがなければ空文字列
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(labelValueEscaper.Replace(value))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	httpRequests = newCounter("transit_http_requests_total",
+		"Number of HTTP requests by endpoint and status code.", "path", "status")
+	httpRequestDuration = newHistogram("transit_http_request_duration_seconds",
+		"HTTP request latency by endpoint and status code.", latencyBuckets, "path", "status")
+
+	upstreamRequests = newCounter("transit_upstream_requests_total",
+		"Number of requests to the ODPT API by data type and status code (error when no response was received).", "type", "status")
+	upstreamErrors = newCounter("transit_upstream_errors_total",
+		"Number of failed requests to the ODPT API by data type and status code (error when no response was received).", "type", "status")
+	upstreamRequestDuration = newHistogram("transit_upstream_request_duration_seconds",
+		"ODPT API request latency by data type.", latencyBuckets, "type")
+
+	odptCacheRequests = newCounter("transit_odpt_cache_requests_total",
+		"Number of vehicle lookups in the ODPT response cache by result (hit, coalesced, miss, breaker_open).", "result")
+
+	vehiclesReturned = newCounter("transit_vehicles_returned_total",
+		"Number of vehicles returned by /location/busvehicle and /gtfsrt/vehiclepositions by operator.", "operator")
+	newestVehicleAge = newGauge("transit_newest_vehicle_age_seconds",
+		"Age of the newest dc:date in the last successful odpt:Bus response by operator.", "operator")
+
+	staticDataRecords = newGauge("transit_static_data_records",
+		"Number of records in the loaded static datasets by operator and data type.", "operator", "type")
+	staticDataLoadDuration = newGauge("transit_static_data_load_duration_seconds",
+		"Time taken to load and index the static data currently in use.")
+	staticDataLoadedTimestamp = newGauge("transit_static_data_loaded_timestamp_seconds",
+		"Unix time when the static data currently in use was loaded.")
+	staticDataReloadErrors = newCounter("transit_static_data_reload_errors_total",
+		"Number of static data reloads rejected because a file could not be parsed.")
+)
+
+var (
+	newestVehicleMu    sync.Mutex
+	newestVehicleDates = make(map[string]time.Time) // 事業者 → 最新のdc:date
+)
+
+// リクエストの件数と所要時間を記録する
+// パスは登録したエンドポイントのもので、クエリは含めない
+func observeRequest(r *http.Request, status int, duration time.Duration) {
+	code := strconv.Itoa(status)
+	path := metricsPath(r.URL.Path)
+	httpRequests.add(1, path, code)
+	httpRequestDuration.observe(duration.Seconds(), path, code)
+}
+
+// 登録したエンドポイントのパス
+var metricsRoutes = map[string]bool{
+	"/location/busvehicle":        true,
+	"/location/busvehicle/stream": true,
+	"/location/busvehicle/ws":     true,
+	"/operators":                  true,
+	"/busstop":                    true,
+	"/busstoppole":                true,
+	"/busstoppole/suggest":        true,
+	"/busroutepattern":            true,
+	"/gtfsrt/vehiclepositions":    true,
+}
+
+// 登録したエンドポイント以外のパスのラベル
+const metricsOtherPath = "other"
+
+// リクエストのパスを、登録したエンドポイントのパスのラベルにする
+// 標柱ごとの発車案内は1つにまとめ、どのエンドポイントにも当たらないパスはすべてotherにして、系列が際限なく増えないようにする
+func metricsPath(path string) string {
+	if metricsRoutes[path] {
+		return path
+	}
+	if sameAs, ok := strings.CutPrefix(path, "/busstoppole/"); ok {
+		if sameAs, ok = strings.CutSuffix(sameAs, "/departures"); ok && sameAs != "" && !strings.Contains(sameAs, "/") {
+			return "/busstoppole/{sameAs}/departures"
+		}
+	}
+	return metricsOtherPath
+}
+
+// ODPT APIへのリクエストの件数、失敗、所要時間を記録する
+func observeUpstreamRequest(apiPath string, status int, latency time.Duration, err error) {
+	dataType := strings.TrimSuffix(strings.TrimPrefix(path.Base(apiPath), "odpt:"), ".json")
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	upstreamRequests.add(1, dataType, code)
+	if err != nil || status != http.StatusOK {
+		upstreamErrors.add(1, dataType, code)
+	}
+	upstreamRequestDuration.observe(latency.Seconds(), dataType)
+}
+
+// 取得できた車両情報のうち最も新しいdc:dateを記録する
+func observeVehicleSnapshot(operator string, buses []ODPTBus) {
+	var newest time.Time
+	for _, bus := range buses {
+		date, err := time.Parse(time.RFC3339, bus.Date)
+		if err == nil && date.After(newest) {
+			newest = date
+		}
+	}
+	if newest.IsZero() {
+		return
+	}
+
+	newestVehicleMu.Lock()
+	defer newestVehicleMu.Unlock()
+	newestVehicleDates[operator] = newest
+}
+
+// 返した車両の数を事業者ごとに記録する
+func observeReturnedVehicles(buses []Bus) {
+	counts := make(map[string]int)
+	for _, bus := range buses {
+		counts[bus.Operator]++
+	}
+	for operator, count := range counts {
+		vehiclesReturned.add(float64(count), operator)
+	}
+}
+
+// 書き出す時点の値で決まるgaugeを更新する
+func updateScrapeMetrics(now time.Time) {
+	static := getStaticData()
+	staticDataRecords.replace(func(set func(value float64, labelValues ...string)) {
+		for _, operator := range static.registry {
+			// 時刻表の概要はscrapeのたびに大きなファイルを読まないよう、/operators で読み込んだ後だけ出す
+			for _, dataset := range static.datasets(operator.ID, false) {
+				set(float64(dataset.Records), operator.ID, dataset.Type)
+			}
+		}
+	})
+	staticDataLoadDuration.set(static.loadDuration.Seconds())
+	staticDataLoadedTimestamp.set(float64(static.loadedAt.UnixNano()) / 1e9)
+
+	newestVehicleAge.replace(func(set func(value float64, labelValues ...string)) {
+		newestVehicleMu.Lock()
+		defer newestVehicleMu.Unlock()
+		for operator, newest := range newestVehicleDates {
+			set(now.Sub(newest).Seconds(), operator)
+		}
+	})
+}
+
+// メトリクスをPrometheusのテキスト形式で返すハンドラー
+// 値はプロセスごとに集計するため、ローカルサーバーでのみ公開する
+func GetMetrics(w http.ResponseWriter, r *http.Request) {
+	updateScrapeMetrics(time.Now())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer := bufio.NewWriter(w)
+	for _, family := range metricFamilies {
+		family.write(writer)
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package transit
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/location/busvehicle", want: "/location/busvehicle"},
+		{path: "/busstoppole/suggest", want: "/busstoppole/suggest"},
+		{path: "/busstoppole/odpt.BusstopPole:Toei.Shinjukueki.1.1/departures", want: "/busstoppole/{sameAs}/departures"},
+		{path: "/busstoppole/odpt.BusstopPole:Toei.Ikebukuroeki.2.1/departures", want: "/busstoppole/{sameAs}/departures"},
+		{path: "/api/busvehicle", want: "other"},
+		{path: "/busstoppole//departures", want: "other"},
+		{path: "/busstoppole/a/b/departures", want: "other"},
+		{path: "/busstoppole/unknown", want: "other"},
+		{path: "/wp-login.php", want: "other"},
+		{path: "/location/busvehicle/", want: "other"},
+		{path: "/", want: "other"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, metricsPath(tt.path), tt.path)
+	}
+}
+
+func TestMetricFamilyReplace(t *testing.T) {
+	family := &metricFamily{name: "test_gauge", kind: metricGauge, labels: []string{"operator"}, series: make(map[string]*metricSeries)}
+	family.set(1, "odpt.Operator:Toei")
+	family.set(2, "odpt.Operator:KeioBus")
+
+	// 前の系列は残さない
+	family.replace(func(set func(value float64, labelValues ...string)) {
+		set(3, "odpt.Operator:Toei")
+	})
+
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	family.write(w)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "# HELP test_gauge \n# TYPE test_gauge gauge\ntest_gauge{operator=\"odpt.Operator:Toei\"} 3\n", sb.String())
+}
@@ -0,0 +1,126 @@
+package transit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+)
+
+// 事業者の登録情報のファイル名 (assetsディレクトリ内)
+const operatorRegistryFile = "operators.json"
+
+// assetsに置くODPTの静的データの型
+var datasetTypes = []string{"BusstopPole", "BusroutePattern", "BusTimetable", "BusstopPoleTimetable"}
+
+// Operator 事業者の登録情報
+type Operator struct {
+	ID        string            `json:"id"`        // odpt:OperatorのsameAs (例: odpt.Operator:Toei)
+	Title     map[string]string `json:"title"`     // 言語タグごとの表示名 (ja, en, ...)
+	AssetName string            `json:"assetName"` // assetsのファイル名 odpt_<型>_<assetName>.json に使う名前
+	Realtime  bool              `json:"realtime"`  // ODPT APIのodpt:Busで車両の位置情報を取得できるか
+}
+
+// OperatorInfo /operators のレスポンスの1事業者分
+type OperatorInfo struct {
+	ID          string            `json:"id"`
+	Title       map[string]string `json:"title"`
+	Supports    OperatorSupport   `json:"supports"`
+	Datasets    []DatasetInfo     `json:"datasets"`
+	DataVersion string            `json:"dataVersion,omitempty"`
+}
+
+// OperatorSupport 事業者について利用できるエンドポイント
+type OperatorSupport struct {
+	Realtime        bool `json:"realtime"`        // /location/busvehicle, /gtfsrt/vehiclepositions, ストリーミング
+	BusstopPole     bool `json:"busstopPole"`     // /busstoppole
+	BusroutePattern bool `json:"busroutePattern"` // /busroutepattern, 推定位置の経路形状
+	BusTimetable    bool `json:"busTimetable"`    // gtfs-export の時刻表
+	// /busstoppole/{sameAs}/departures の時刻表 (車両の位置情報だけでも発車案内は返す)
+	BusstopPoleTimetable bool `json:"busstopPoleTimetable"`
+}
+
+// DatasetInfo assetsにある静的データファイルの概要
+// versionはレコードのdc:dateのうち最も新しいもの
+type DatasetInfo struct {
+	Type    string `json:"type"`
+	Records int    `json:"records"`
+	Version string `json:"version,omitempty"`
+}
+
+// 登録されている事業者を登録順に返す
+func operators() []Operator {
+	return getStaticData().registry
+}
+
+// 事業者のIDから登録情報を引く。登録されていない場合はnil
+func lookupOperator(id string) *Operator {
+	return getStaticData().operatorsByID[id]
+}
+
+// 時刻表を置くassetsのサブディレクトリ。assets.goの埋め込み (*.json) に含まれない
+const timetableAssetDir = "timetables"
+
+// assetsにある事業者のデータファイルのファイル名 (例: odpt_BusstopPole_Toei.json)
+func assetFileName(dataType string, operator *Operator) string {
+	return fmt.Sprintf("odpt_%s_%s.json", dataType, operator.AssetName)
+}
+
+// 時刻表の型か。時刻表は大きく、埋め込むとすべてのVercelの関数が大きくなるため、timetablesディレクトリに置く
+func isTimetableDataset(dataType string) bool {
+	return dataType == "BusTimetable" || dataType == "BusstopPoleTimetable"
+}
+
+// assetsディレクトリからのデータファイルのパス (例: odpt_BusstopPole_Toei.json, timetables/odpt_BusTimetable_Toei.json)
+func assetPath(dataType string, operator *Operator) string {
+	if isTimetableDataset(dataType) {
+		return path.Join(timetableAssetDir, assetFileName(dataType, operator))
+	}
+	return assetFileName(dataType, operator)
+}
+
+// 事業者の登録情報と、assetsにあるデータから利用できるエンドポイントをまとめる
+func operatorInfo(static *staticData, operator Operator) OperatorInfo {
+	info := OperatorInfo{
+		ID:       operator.ID,
+		Title:    operator.Title,
+		Supports: OperatorSupport{Realtime: operator.Realtime},
+		Datasets: make([]DatasetInfo, 0, len(datasetTypes)),
+	}
+	for _, dataset := range static.datasets(operator.ID, true) {
+		switch dataset.Type {
+		case "BusstopPole":
+			info.Supports.BusstopPole = true
+		case "BusroutePattern":
+			info.Supports.BusroutePattern = true
+		case "BusTimetable":
+			info.Supports.BusTimetable = true
+		case "BusstopPoleTimetable":
+			info.Supports.BusstopPoleTimetable = true
+		}
+		info.Datasets = append(info.Datasets, dataset)
+		if dataset.Version > info.DataVersion {
+			info.DataVersion = dataset.Version
+		}
+	}
+	return info
+}
+
+// 事業者の一覧を返すハンドラー
+func GetOperators(w http.ResponseWriter, r *http.Request) {
+	static := getStaticData()
+	infos := make([]OperatorInfo, 0, len(static.registry))
+	for _, operator := range static.registry {
+		infos = append(infos, operatorInfo(static, operator))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	logResult(r.Context(), nil, len(infos))
+}
@@ -0,0 +1,242 @@
+package transit
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// 半角カタカナ (U+FF61〜U+FF9F) に対応する全角の文字
+var halfWidthKana = []rune("。「」、・ヲァィゥェォャュョッーアイウエオカキクケコサシスセソタチツテトナニヌネノハヒフヘホマミムメモヤユヨラリルレロワン゛゜")
+
+// バス停名の表記ゆれを吸収するための正規化
+// 全角の英数字・記号と半角カタカナを標準の幅に、カタカナをひらがなに、英字を小文字にし、空白と中黒を取り除く
+func normalizeTitle(title string) string {
+	out := make([]rune, 0, len(title))
+	for _, r := range title {
+		switch {
+		case r >= '！' && r <= '～':
+			r -= '！' - '!'
+		case r >= '｡' && r <= 'ﾟ':
+			r = halfWidthKana[r-'｡']
+		}
+
+		switch {
+		case r == '゛' || r == '\u3099':
+			// 濁点は直前のかなと合成する (半角カタカナの濁点は別の文字になっている)
+			if n := len(out); n > 0 {
+				out[n-1] = voicedKana(out[n-1], false)
+			}
+			continue
+		case r == '゜' || r == '\u309A':
+			if n := len(out); n > 0 {
+				out[n-1] = voicedKana(out[n-1], true)
+			}
+			continue
+		case r == '・' || unicode.IsSpace(r):
+			continue
+		case r >= 'ァ' && r <= 'ヶ':
+			r -= 'ァ' - 'ぁ'
+		}
+		out = append(out, unicode.ToLower(r))
+	}
+	return string(out)
+}
+
+// ひらがなに濁点 (semiがtrueの場合は半濁点) を付けた文字を返す。付けられない場合はそのまま
+func voicedKana(r rune, semi bool) rune {
+	switch {
+	case semi && strings.ContainsRune("はひふへほ", r):
+		return r + 2
+	case semi:
+		return r
+	case strings.ContainsRune("かきくけこさしすせそたちつてとはひふへほ", r):
+		return r + 1
+	case r == 'う':
+		return 'ゔ'
+	}
+	return r
+}
+
+// ひらがな1文字のヘボン式ローマ字
+var kanaRomaji = func() map[rune]string {
+	table := make(map[rune]string)
+	for _, pair := range strings.Fields(`あa いi うu えe おo かka きki くku けke こko さsa しshi すsu せse そso
+		たta ちchi つtsu てte とto なna にni ぬnu ねne のno はha ひhi ふfu へhe ほho まma みmi むmu めme もmo
+		やya ゆyu よyo らra りri るru れre ろro わwa ゐi ゑe をo んn がga ぎgi ぐgu げge ごgo ざza じji ずzu ぜze ぞzo
+		だda ぢji づzu でde どdo ばba びbi ぶbu べbe ぼbo ぱpa ぴpi ぷpu ぺpe ぽpo ゔvu ぁa ぃi ぅu ぇe ぉo ゎwa`) {
+		r := []rune(pair)
+		table[r[0]] = string(r[1:])
+	}
+	return table
+}()
+
+// 拗音の小書きのかなと、付ける母音
+var smallYKana = map[rune]string{'ゃ': "a", 'ゅ': "u", 'ょ': "o"}
+
+// ひらがなの読みをヘボン式のローマ字にする。かな以外の文字は読み飛ばす
+func kanaToRomaji(kana string) string {
+	var sb strings.Builder
+	runes := []rune(kana)
+	double := false // 直前が促音 (っ)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == 'っ' {
+			double = true
+			continue
+		}
+
+		syllable, ok := kanaRomaji[r]
+		if !ok {
+			if vowel, small := smallYKana[r]; small {
+				syllable = "y" + vowel
+			} else {
+				// 長音符、漢字など
+				double = false
+				continue
+			}
+		}
+
+		// 拗音 (きゃ → kya, しゃ → sha, じゃ → ja)
+		if i+1 < len(runes) && len(syllable) > 1 && strings.HasSuffix(syllable, "i") {
+			if vowel, small := smallYKana[runes[i+1]]; small {
+				base := strings.TrimSuffix(syllable, "i")
+				if strings.HasSuffix(base, "sh") || strings.HasSuffix(base, "ch") || strings.HasSuffix(base, "j") {
+					syllable = base + vowel
+				} else {
+					syllable = base + "y" + vowel
+				}
+				i++
+			}
+		}
+
+		if double {
+			// 促音は次の子音を重ねる (っち → tchi)
+			if strings.HasPrefix(syllable, "ch") {
+				sb.WriteByte('t')
+			} else if c := syllable[0]; !strings.ContainsRune("aiueon", rune(c)) {
+				sb.WriteByte(c)
+			}
+			double = false
+		}
+		sb.WriteString(syllable)
+	}
+	return sb.String()
+}
+
+// ローマ字の綴りの違い (ヘボン式と訓令式、長音の表記、撥音のm) をそろえる
+var (
+	romajiSpellings = strings.NewReplacer("shi", "si", "sh", "sy", "chi", "ti", "ch", "ty", "tsu", "tu", "fu", "hu", "ji", "zi", "jy", "zy", "j", "zy", "mb", "nb", "mp", "np")
+	romajiLongVowel = strings.NewReplacer("ou", "o", "oo", "o", "uu", "u")
+)
+
+// ローマ字の比較用の形にする。英数字以外を取り除き、綴りの違いをそろえる
+func canonicalRomaji(text string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		}
+	}
+	return romajiLongVowel.Replace(romajiSpellings.Replace(sb.String()))
+}
+
+// busstopSearchKeys バス停名の検索に使う正規化した文字列
+type busstopSearchKeys struct {
+	title  string // 正規化したバス停名
+	kana   string // 正規化した読み (ひらがな)
+	romaji string // 読みのローマ字 (canonicalRomaji)
+	en     string // 英語名 (canonicalRomaji)
+}
+
+func newBusstopSearchKeys(title, kana, en string) busstopSearchKeys {
+	keys := busstopSearchKeys{
+		title: normalizeTitle(title),
+		kana:  normalizeTitle(kana),
+		en:    canonicalRomaji(en),
+	}
+	keys.romaji = canonicalRomaji(kanaToRomaji(keys.kana))
+	return keys
+}
+
+// titleQuery バス停名の検索語
+type titleQuery struct {
+	text   string // normalizeTitleで正規化した検索語。バス停名と読みに対して照合する
+	romaji string // 検索語が英数字だけの場合のローマ字。読みのローマ字と英語名に対して照合する
+}
+
+// 検索語を正規化する。空の場合はnil
+func newTitleQuery(value string) *titleQuery {
+	text := normalizeTitle(value)
+	if text == "" {
+		return nil
+	}
+
+	query := &titleQuery{text: text}
+	ascii := true
+	for _, r := range text {
+		if r > unicode.MaxASCII {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		query.romaji = canonicalRomaji(text)
+	}
+	return query
+}
+
+// 検索語との一致の順位
+const (
+	titleMatchExact     = iota // 完全一致
+	titleMatchPrefix           // 前方一致
+	titleMatchSubstring        // 部分一致
+	titleMatchNone
+)
+
+// 検索語とバス停名・読み・ローマ字・英語名を照合し、最もよい一致の順位を返す
+func (q *titleQuery) match(keys busstopSearchKeys) int {
+	best := titleMatchNone
+	check := func(key, text string) {
+		switch {
+		case key == "" || text == "":
+		case key == text:
+			best = min(best, titleMatchExact)
+		case strings.HasPrefix(key, text):
+			best = min(best, titleMatchPrefix)
+		case strings.Contains(key, text):
+			best = min(best, titleMatchSubstring)
+		}
+	}
+	check(keys.title, q.text)
+	check(keys.kana, q.text)
+	check(keys.romaji, q.romaji)
+	check(keys.en, q.romaji)
+	return best
+}
+
+// 並べ替えに使う一致の順位。検索語がない場合はすべて同じ順位
+func (q *titleQuery) rank(keys busstopSearchKeys) int {
+	if q == nil {
+		return titleMatchNone
+	}
+	return q.match(keys)
+}
+
+// 一致の順位でitemsを安定ソートする。同じ順位のものは元の順序のまま
+func sortByRank[T any](items []T, ranks []int) {
+	sort.Stable(rankedItems[T]{items, ranks})
+}
+
+// rankedItems itemsとranksを同じ順に並べ替える
+type rankedItems[T any] struct {
+	items []T
+	ranks []int
+}
+
+func (r rankedItems[T]) Len() int           { return len(r.items) }
+func (r rankedItems[T]) Less(i, j int) bool { return r.ranks[i] < r.ranks[j] }
+func (r rankedItems[T]) Swap(i, j int) {
+	r.items[i], r.items[j] = r.items[j], r.items[i]
+	r.ranks[i], r.ranks[j] = r.ranks[j], r.ranks[i]
+}
@@ -0,0 +1,114 @@
+package transit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{name: "kanji unchanged", title: "渋谷駅前", want: "渋谷駅前"},
+		{name: "katakana to hiragana", title: "シブヤ", want: "しぶや"},
+		{name: "half-width katakana with dakuten", title: "ｼﾌﾞﾔ", want: "しぶや"},
+		{name: "half-width katakana with handakuten", title: "ﾊﾟﾚｽ", want: "ぱれす"},
+		{name: "half-width prolonged sound mark", title: "ﾊﾞｽﾀｰﾐﾅﾙ", want: "ばすたーみなる"},
+		{name: "combining dakuten", title: "シ\u3099ュク", want: "じゅく"},
+		{name: "handakuten on an unsupported kana", title: "カ\u309A", want: "か"},
+		{name: "vu", title: "ヴ", want: "ゔ"},
+		{name: "full-width alphanumerics", title: "ＲＨ０１", want: "rh01"},
+		{name: "full-width parentheses", title: "（都０１）", want: "(都01)"},
+		{name: "spaces", title: "六本木 ヒルズ　前", want: "六本木ひるず前"},
+		{name: "middle dot", title: "西新宿・五丁目", want: "西新宿五丁目"},
+		{name: "english", title: "Shibuya Station", want: "shibuyastation"},
+		{name: "empty", title: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, normalizeTitle(tt.title))
+		})
+	}
+}
+
+func TestKanaToRomaji(t *testing.T) {
+	tests := []struct {
+		kana string
+		want string
+	}{
+		{kana: "しぶや", want: "shibuya"},
+		{kana: "しんじゅく", want: "shinjuku"},
+		{kana: "しんばし", want: "shinbashi"},
+		{kana: "とうきょうえき", want: "toukyoueki"},
+		{kana: "しゃこ", want: "shako"},
+		{kana: "ちゃや", want: "chaya"},
+		{kana: "じょうとう", want: "joutou"},
+		{kana: "がっこう", want: "gakkou"},
+		{kana: "まっちゃ", want: "matcha"},
+		{kana: "ろっぽんぎ", want: "roppongi"},
+		{kana: "ばすたーみなる", want: "basutaminaru"},
+		{kana: "ふじみ", want: "fujimi"},
+		{kana: "ゃ", want: "ya"},
+		{kana: "いっ", want: "i"},
+		{kana: "っあ", want: "a"},
+		{kana: "六本木ひるず", want: "hiruzu"},
+		{kana: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kana, func(t *testing.T) {
+			assert.Equal(t, tt.want, kanaToRomaji(tt.kana))
+		})
+	}
+}
+
+func TestCanonicalRomaji(t *testing.T) {
+	// 同じ読みの綴りの違いが同じ形になる
+	tests := []struct {
+		a, b string
+	}{
+		{a: "Shimbashi", b: kanaToRomaji("しんばし")},
+		{a: "Tokyo", b: kanaToRomaji("とうきょう")},
+		{a: "Chuo", b: kanaToRomaji("ちゅうおう")},
+		{a: "Oji", b: kanaToRomaji("おうじ")},
+		{a: "sinjuku", b: "Shinjuku"},
+		{a: "Roppongi Hills", b: "roppongi-hills"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a, func(t *testing.T) {
+			assert.Equal(t, canonicalRomaji(tt.a), canonicalRomaji(tt.b))
+		})
+	}
+}
+
+func TestTitleQueryMatch(t *testing.T) {
+	keys := newBusstopSearchKeys("渋谷駅前", "しぶやえきまえ", "Shibuya Station")
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{query: "渋谷駅前", want: titleMatchExact},
+		{query: "渋谷", want: titleMatchPrefix},
+		{query: "ｼﾌﾞﾔ", want: titleMatchPrefix},
+		{query: "駅前", want: titleMatchSubstring},
+		{query: "えき", want: titleMatchSubstring},
+		{query: "shibuya", want: titleMatchPrefix},
+		{query: "SIBUYA EKIMAE", want: titleMatchExact},
+		{query: "station", want: titleMatchSubstring},
+		{query: "ikebukuro", want: titleMatchNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.want, newTitleQuery(tt.query).match(keys))
+		})
+	}
+
+	assert.Nil(t, newTitleQuery(" ・ "))
+}
@@ -0,0 +1,155 @@
+package transit
+
+import (
+	"math"
+	"sort"
+)
+
+// 空間インデックスのセルの大きさ (度)。緯度方向で約550m
+const spatialCellSize = 0.005
+
+// spatialGrid 座標を一定間隔のセルに振り分けた空間インデックス
+type spatialGrid struct {
+	lats    []float64
+	longs   []float64
+	cells   map[[2]int][]int
+	minCell [2]int
+	maxCell [2]int
+}
+
+// spatialMatch 空間検索の結果 (インデックスと距離 (m))
+type spatialMatch struct {
+	index    int
+	distance float64
+}
+
+func newSpatialGrid(lats, longs []float64) *spatialGrid {
+	g := &spatialGrid{
+		lats:  lats,
+		longs: longs,
+		cells: make(map[[2]int][]int),
+	}
+
+	for i := range lats {
+		cell := cellOf(lats[i], longs[i])
+		if i == 0 {
+			g.minCell, g.maxCell = cell, cell
+		}
+		for d := 0; d < 2; d++ {
+			if cell[d] < g.minCell[d] {
+				g.minCell[d] = cell[d]
+			}
+			if cell[d] > g.maxCell[d] {
+				g.maxCell[d] = cell[d]
+			}
+		}
+		g.cells[cell] = append(g.cells[cell], i)
+	}
+
+	return g
+}
+
+func cellOf(lat, long float64) [2]int {
+	return [2]int{int(math.Floor(lat / spatialCellSize)), int(math.Floor(long / spatialCellSize))}
+}
+
+// 指定地点から近い順に最大limit件を返す
+// radius (m) が正の場合はその範囲内に限定し、limitが0以下の場合は範囲内をすべて返す
+// acceptがnilでない場合はacceptがtrueを返した点のみを対象とする
+func (g *spatialGrid) nearby(lat, long, radius float64, limit int, accept func(int) bool) []spatialMatch {
+	if len(g.lats) == 0 {
+		return nil
+	}
+
+	center := cellOf(lat, long)
+
+	// セル1つ分の最小の幅 (m)。経度方向は高緯度ほど狭くなる
+	cellMeters := spatialCellSize * math.Pi / 180 * earthRadius * math.Cos(math.Min(math.Abs(lat)+spatialCellSize, 89)*math.Pi/180)
+
+	var matches []spatialMatch
+	for ring := 0; ; ring++ {
+		// 中心セルからringだけ離れた外周のセルを、データの存在する範囲に絞って走査
+		latFrom, latTo := max(center[0]-ring, g.minCell[0]), min(center[0]+ring, g.maxCell[0])
+		longFrom, longTo := max(center[1]-ring, g.minCell[1]), min(center[1]+ring, g.maxCell[1])
+		for cellLat := latFrom; cellLat <= latTo; cellLat++ {
+			onEdge := cellLat == center[0]-ring || cellLat == center[0]+ring
+			for cellLong := longFrom; cellLong <= longTo; cellLong++ {
+				if !onEdge && cellLong != center[1]-ring && cellLong != center[1]+ring {
+					// 外周の内側は前のringで走査済み
+					cellLong = max(cellLong, center[1]+ring-1)
+					continue
+				}
+				for _, i := range g.cells[[2]int{cellLat, cellLong}] {
+					if accept != nil && !accept(i) {
+						continue
+					}
+					distance := haversineDistance(lat, long, g.lats[i], g.longs[i])
+					if radius > 0 && distance > radius {
+						continue
+					}
+					matches = append(matches, spatialMatch{index: i, distance: distance})
+				}
+			}
+		}
+
+		// 未走査のセルにある点は少なくともこの距離だけ離れている
+		searched := float64(ring) * cellMeters
+		if radius > 0 && searched >= radius {
+			break
+		}
+		if limit > 0 && len(matches) >= limit {
+			sortMatches(matches)
+			if matches[limit-1].distance <= searched {
+				break
+			}
+		}
+		if center[0]-ring <= g.minCell[0] && center[0]+ring >= g.maxCell[0] &&
+			center[1]-ring <= g.minCell[1] && center[1]+ring >= g.maxCell[1] {
+			break
+		}
+	}
+
+	sortMatches(matches)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// 矩形範囲内の点をインデックス順に返す
+// acceptがnilでない場合はacceptがtrueを返した点のみを対象とする
+func (g *spatialGrid) within(bbox *boundingBox, accept func(int) bool) []int {
+	if len(g.lats) == 0 {
+		return nil
+	}
+
+	minCell := cellOf(bbox.minLat, bbox.minLong)
+	maxCell := cellOf(bbox.maxLat, bbox.maxLong)
+
+	var indexes []int
+	for cellLat := max(minCell[0], g.minCell[0]); cellLat <= min(maxCell[0], g.maxCell[0]); cellLat++ {
+		for cellLong := max(minCell[1], g.minCell[1]); cellLong <= min(maxCell[1], g.maxCell[1]); cellLong++ {
+			for _, i := range g.cells[[2]int{cellLat, cellLong}] {
+				if !bbox.contains(g.lats[i], g.longs[i]) {
+					continue
+				}
+				if accept != nil && !accept(i) {
+					continue
+				}
+				indexes = append(indexes, i)
+			}
+		}
+	}
+
+	sort.Ints(indexes)
+	return indexes
+}
+
+func sortMatches(matches []spatialMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].index < matches[j].index
+	})
+}
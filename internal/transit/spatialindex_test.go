@@ -0,0 +1,121 @@
+package transit
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 東京周辺の約10km四方に散らばる点。セルの境界をまたぐよう乱数で決める
+func testSpatialPoints() (lats, longs []float64) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		lats = append(lats, 35.65+r.Float64()*0.1)
+		longs = append(longs, 139.65+r.Float64()*0.1)
+	}
+	return lats, longs
+}
+
+// 全件を調べて近い順に並べた結果 (spatialGrid.nearbyの期待値)
+func bruteForceNearby(lats, longs []float64, lat, long, radius float64, limit int, accept func(int) bool) []spatialMatch {
+	var matches []spatialMatch
+	for i := range lats {
+		if accept != nil && !accept(i) {
+			continue
+		}
+		distance := haversineDistance(lat, long, lats[i], longs[i])
+		if radius > 0 && distance > radius {
+			continue
+		}
+		matches = append(matches, spatialMatch{index: i, distance: distance})
+	}
+	sortMatches(matches)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+func TestSpatialGridNearby(t *testing.T) {
+	even := func(i int) bool { return i%2 == 0 }
+	tests := []struct {
+		name      string
+		lat, long float64
+		radius    float64
+		limit     int
+		accept    func(int) bool
+	}{
+		{name: "nearest one", lat: 35.69, long: 139.70, limit: 1},
+		{name: "nearest ten", lat: 35.69, long: 139.70, limit: 10},
+		{name: "within radius", lat: 35.69, long: 139.70, radius: 1000},
+		{name: "radius and limit", lat: 35.69, long: 139.70, radius: 2000, limit: 5},
+		{name: "radius smaller than a cell", lat: 35.7012, long: 139.7104, radius: 150},
+		{name: "on a cell boundary", lat: 35.700, long: 139.700, limit: 20},
+		{name: "accept filter", lat: 35.69, long: 139.70, limit: 10, accept: even},
+		{name: "outside the data", lat: 35.0, long: 139.0, limit: 3},
+		{name: "outside the data within radius", lat: 35.0, long: 139.0, radius: 1000},
+		{name: "limit larger than the data", lat: 35.69, long: 139.70, limit: 1000},
+	}
+
+	lats, longs := testSpatialPoints()
+	grid := newSpatialGrid(lats, longs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := grid.nearby(tt.lat, tt.long, tt.radius, tt.limit, tt.accept)
+			want := bruteForceNearby(lats, longs, tt.lat, tt.long, tt.radius, tt.limit, tt.accept)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestSpatialGridWithin(t *testing.T) {
+	tests := []struct {
+		name   string
+		bbox   boundingBox
+		accept func(int) bool
+	}{
+		{name: "inside one cell", bbox: boundingBox{minLong: 139.701, minLat: 35.651, maxLong: 139.704, maxLat: 35.654}},
+		{name: "across cells", bbox: boundingBox{minLong: 139.68, minLat: 35.66, maxLong: 139.73, maxLat: 35.71}},
+		{name: "larger than the data", bbox: boundingBox{minLong: 139.0, minLat: 35.0, maxLong: 140.5, maxLat: 36.5}},
+		{name: "outside the data", bbox: boundingBox{minLong: 140.0, minLat: 36.0, maxLong: 140.1, maxLat: 36.1}},
+		{name: "accept filter", bbox: boundingBox{minLong: 139.68, minLat: 35.66, maxLong: 139.73, maxLat: 35.71}, accept: func(i int) bool { return i%3 == 0 }},
+	}
+
+	lats, longs := testSpatialPoints()
+	grid := newSpatialGrid(lats, longs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []int
+			for i := range lats {
+				if tt.bbox.contains(lats[i], longs[i]) && (tt.accept == nil || tt.accept(i)) {
+					want = append(want, i)
+				}
+			}
+			got := grid.within(&tt.bbox, tt.accept)
+			assert.Equal(t, want, got)
+			assert.True(t, sort.IntsAreSorted(got))
+		})
+	}
+}
+
+func TestSpatialGridEmpty(t *testing.T) {
+	grid := newSpatialGrid(nil, nil)
+	assert.Nil(t, grid.nearby(35.69, 139.70, 0, 10, nil))
+	assert.Nil(t, grid.within(&boundingBox{minLong: 139, minLat: 35, maxLong: 140, maxLat: 36}, nil))
+}
+
+func TestSpatialGridNearbyOrder(t *testing.T) {
+	// 同じ距離の点はインデックス順
+	lats := []float64{35.7010, 35.7000, 35.6990, 35.7000}
+	longs := []float64{139.7000, 139.7020, 139.7000, 139.7020}
+	grid := newSpatialGrid(lats, longs)
+
+	got := grid.nearby(35.7000, 139.7000, 0, 0, nil)
+	indexes := make([]int, len(got))
+	for i, match := range got {
+		indexes[i] = match.index
+	}
+	assert.Equal(t, []int{0, 2, 1, 3}, indexes)
+}
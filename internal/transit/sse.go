@@ -0,0 +1,126 @@
+package transit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 接続を維持するためにコメント行を送る間隔
+const streamHeartbeatInterval = 30 * time.Second
+
+// vehicleRemoval 車両がフィードから消えた、または条件に合わなくなったことを通知するイベント
+type vehicleRemoval struct {
+	ID       string `json:"id"`
+	Operator string `json:"operator"`
+}
+
+// 車両の変化をServer-Sent Eventsで配信するハンドラー
+func GetBusVehicleStream(w http.ResponseWriter, r *http.Request) {
+	// クエリパラメータからoperatorを取得 (カンマ区切りで複数指定可)
+	operators, err := parseRealtimeOperators(r.URL.Query().Get("operator"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// /location/busvehicle と同じフィルタパラメータと表示範囲を取得
+	filter, err := parseBusFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 展開するバス停フィールドを取得
+	expand, err := parseExpand(r.URL.Query().Get("expand"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 名称の言語を取得 (langパラメータまたはAccept-Language)
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sub, snapshot := sharedVehicleHub.subscribe(operators)
+	defer sharedVehicleHub.unsubscribe(sub)
+
+	log.Printf("Started vehicle stream for operator: %s", strings.Join(operators, ","))
+
+	// クライアントに送信済みで条件に合っている車両
+	sent := make(map[string]bool)
+	handle := func(event vehicleEvent) error {
+		if event.kind == vehicleEventUpdate && filter.matches(event.bus) {
+			sent[event.bus.ID] = true
+			return writeSSEEvent(w, vehicleEventUpdate, trimExpanded(event.bus, expand).localized(lang))
+		}
+		// 消えた車両と、条件に合わなくなった車両 (表示範囲から出たなど) は削除を通知する
+		if sent[event.bus.ID] {
+			delete(sent, event.bus.ID)
+			return writeSSEEvent(w, vehicleEventRemove, vehicleRemoval{ID: event.bus.ID, Operator: event.bus.Operator})
+		}
+		return nil
+	}
+
+	for _, bus := range snapshot {
+		if err := handle(vehicleEvent{kind: vehicleEventUpdate, bus: bus}); err != nil {
+			log.Printf("Error writing stream: %v", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Closed vehicle stream for operator: %s", strings.Join(operators, ","))
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				log.Printf("Vehicle stream dropped for operator: %s", strings.Join(operators, ","))
+				return
+			}
+			if err := handle(event); err != nil {
+				log.Printf("Error writing stream: %v", err)
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				log.Printf("Error writing stream: %v", err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// Server-Sent Eventsのイベントを1件書き出す
+func writeSSEEvent(w http.ResponseWriter, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,401 @@
+package transit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"transport-realtime/assets"
+)
+
+// assetsディレクトリの変更を確認する間隔
+const assetWatchInterval = 2 * time.Second
+
+// staticData assetsから読み込んだ静的データ一式
+// 起動時に一度だけ読み込んでパースし、以降のリクエストではメモリ上のものを使う
+// assetsが更新された場合は新しいstaticDataを最後まで組み立ててから丸ごと差し替えるため、
+// リクエストが読み込み途中のデータを参照することはない
+type staticData struct {
+	registry      []Operator
+	operatorsByID map[string]*Operator
+	operatorData  map[string]*operatorData // 事業者のID → 事業者のデータ
+	loadedAt      time.Time
+	loadDuration  time.Duration
+}
+
+// operatorData 1事業者分の静的データ
+type operatorData struct {
+	busstops      *busstopIndex
+	busstopsErr   error // バス停データを読み込めなかった理由 (ファイルがない場合はfs.ErrNotExist)
+	summaries     map[string]*BusstopPoleSummary
+	patterns      []ODPTBusroutePattern
+	patternsErr   error // 系統データを読み込めなかった理由 (ファイルがない場合はfs.ErrNotExist)
+	routePatterns map[string]*routePattern
+	parents       *parentBusstopIndex     // 標柱をまとめた親のバス停 (バス停データがある場合)
+	timetables    poleTimetables          // 標柱ごとの時刻表 (標柱時刻表データがある場合)
+	datasets      map[string]*DatasetInfo // データ型 → ファイルの概要 (ファイルがない型は含まない)
+	busTimetable  *lazyDatasetInfo        // 時刻表の概要 (ファイルがある場合)。ファイルが大きいため初めて使うときに読み込む
+}
+
+// lazyDatasetInfo 初めて使うときに作るデータファイルの概要
+type lazyDatasetInfo struct {
+	once sync.Once
+	load func() *DatasetInfo
+	info atomic.Pointer[DatasetInfo]
+}
+
+// 概要を返す。まだ読み込んでいない場合は読み込む。読み込めなかった場合はnil
+func (l *lazyDatasetInfo) get() *DatasetInfo {
+	l.once.Do(func() {
+		l.info.Store(l.load())
+	})
+	return l.info.Load()
+}
+
+// 読み込み済みの概要を返す。まだ読み込んでいない場合はnil
+func (l *lazyDatasetInfo) loaded() *DatasetInfo {
+	return l.info.Load()
+}
+
+var (
+	currentStaticData atomic.Pointer[staticData]
+	staticDataMu      sync.Mutex // 読み込みと再読み込みを直列にする
+)
+
+// 現在の静的データを返す。まだ読み込んでいない場合は読み込む
+// Vercelではインスタンスごとに最初の呼び出しで一度だけ読み込まれる
+func getStaticData() *staticData {
+	if data := currentStaticData.Load(); data != nil {
+		return data
+	}
+
+	staticDataMu.Lock()
+	defer staticDataMu.Unlock()
+
+	if data := currentStaticData.Load(); data != nil {
+		return data
+	}
+	data, err := loadStaticData(assetFS, timetableFS)
+	if err != nil {
+		// 読み込めたデータだけで続行し、読み込めなかったデータのエンドポイントはエラーを返す
+		log.Printf("Error loading static data: %v", err)
+	}
+	currentStaticData.Store(data)
+	return data
+}
+
+// 静的データを読み込む。ローカルサーバーでは起動時に呼び、最初のリクエストで読み込みを待たないようにする
+func LoadStaticData() {
+	getStaticData()
+}
+
+// 静的データを読み込み直して差し替える
+// 読み込みに失敗したファイルがある場合は差し替えず、それまでのデータを使い続ける
+func reloadStaticData() {
+	staticDataMu.Lock()
+	defer staticDataMu.Unlock()
+
+	data, err := loadStaticData(assetFS, timetableFS)
+	if err != nil {
+		log.Printf("Error reloading static data, keeping previous data: %v", err)
+		staticDataReloadErrors.add(1)
+		return
+	}
+	currentStaticData.Store(data)
+}
+
+// assetsディレクトリを監視し、ファイルが更新されたら静的データを読み込み直す
+// 書き込み途中のファイルを読まないよう、変更後に一度内容が落ち着いたことを確認してから読み込む
+func WatchAssetsDir(dir string) {
+	go func() {
+		last, err := assetDirSignature(dir)
+		if err != nil {
+			log.Printf("Error watching assets directory: %v", err)
+		}
+		pending := ""
+		ticker := time.NewTicker(assetWatchInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			signature, err := assetDirSignature(dir)
+			if err != nil {
+				// ディレクトリが一時的に読めない場合はデータを空にせず次の確認を待つ
+				log.Printf("Error watching assets directory: %v", err)
+				continue
+			}
+			if signature == last {
+				pending = ""
+				continue
+			}
+			if signature != pending {
+				pending = signature
+				continue
+			}
+
+			log.Printf("Detected changes in %s, reloading static data", dir)
+			last, pending = signature, ""
+			reloadStaticData()
+		}
+	}()
+}
+
+// assetsディレクトリ直下とtimetablesディレクトリのJSONファイルの名前・サイズ・更新日時をまとめた文字列
+func assetDirSignature(dir string) (string, error) {
+	var sb strings.Builder
+	for _, sub := range []string{"", timetableAssetDir} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			if sub != "" && errors.Is(err, fs.ErrNotExist) {
+				// timetablesディレクトリは時刻表を取得するまでない
+				continue
+			}
+			return "", err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				// 一覧の取得後に削除されたファイル
+				continue
+			}
+			fmt.Fprintf(&sb, "%s:%d:%d\n", path.Join(sub, entry.Name()), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return sb.String(), nil
+}
+
+// 事業者の登録情報とすべての事業者のデータファイルを読み込む
+// 読み込めなかったファイルがある場合もそれ以外のデータを返し、エラーをまとめて返す (ファイルがないのはエラーではない)
+// 時刻表はtimetablesから読む (ディスク上のassetsを使う場合はfsysと同じ)
+func loadStaticData(fsys, timetables fs.FS) (*staticData, error) {
+	start := time.Now()
+
+	registry, err := readOperatorRegistry(fsys)
+	if err != nil {
+		err = fmt.Errorf("loading %s: %w", operatorRegistryFile, err)
+	}
+
+	data := &staticData{
+		registry:      registry,
+		operatorsByID: make(map[string]*Operator, len(registry)),
+		operatorData:  make(map[string]*operatorData, len(registry)),
+	}
+	errs := []error{err}
+	busstops, patterns := 0, 0
+	for i := range registry {
+		operator := &registry[i]
+		operatorData, operatorErrs := loadOperatorData(fsys, timetables, operator)
+		data.operatorsByID[operator.ID] = operator
+		data.operatorData[operator.ID] = operatorData
+		errs = append(errs, operatorErrs...)
+		if operatorData.busstops != nil {
+			busstops += len(operatorData.busstops.busstops)
+		}
+		patterns += len(operatorData.patterns)
+	}
+
+	data.loadedAt = time.Now()
+	data.loadDuration = data.loadedAt.Sub(start)
+	if err := errors.Join(errs...); err != nil {
+		return data, err
+	}
+	log.Printf("Loaded static data for %d operators (%d busstops, %d route patterns) in %v", len(registry), busstops, patterns, data.loadDuration)
+	return data, nil
+}
+
+// 事業者の登録情報を読み込む。assetsにoperators.jsonがなければバイナリに埋め込んだものを使う
+func readOperatorRegistry(fsys fs.FS) ([]Operator, error) {
+	data, err := fs.ReadFile(fsys, operatorRegistryFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = fs.ReadFile(assets.FS, operatorRegistryFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var registry []Operator
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// 1事業者分のデータファイルを読み込み、索引を組み立てる
+func loadOperatorData(fsys, timetables fs.FS, operator *Operator) (*operatorData, []error) {
+	data := &operatorData{datasets: make(map[string]*DatasetInfo)}
+	var errs []error
+
+	var odptBusstops []ODPTBusstopPole
+	data.busstopsErr = readODPTAsset(fsys, assetPath("BusstopPole", operator), &odptBusstops)
+	if data.busstopsErr == nil {
+		data.busstops = newBusstopIndex(odptBusstops)
+		data.summaries = newBusstopPoleSummaries(data.busstops.busstops)
+		dates := make([]string, 0, len(odptBusstops))
+		for _, odptBusstop := range odptBusstops {
+			dates = append(dates, odptBusstop.Date)
+		}
+		data.datasets["BusstopPole"] = newDatasetInfo("BusstopPole", dates)
+	} else if !errors.Is(data.busstopsErr, fs.ErrNotExist) {
+		errs = append(errs, data.busstopsErr)
+	}
+
+	data.patternsErr = readODPTAsset(fsys, assetPath("BusroutePattern", operator), &data.patterns)
+	if data.patternsErr == nil {
+		data.routePatterns = newRoutePatterns(data.patterns)
+		dates := make([]string, 0, len(data.patterns))
+		for _, odptPattern := range data.patterns {
+			dates = append(dates, odptPattern.Date)
+		}
+		data.datasets["BusroutePattern"] = newDatasetInfo("BusroutePattern", dates)
+	} else if !errors.Is(data.patternsErr, fs.ErrNotExist) {
+		errs = append(errs, data.patternsErr)
+	}
+
+	if data.busstops != nil {
+		data.parents = newParentBusstopIndex(operator.ID, data.busstops, data.patterns)
+	}
+
+	var odptPoleTimetables []ODPTBusstopPoleTimetable
+	if err := readODPTAsset(timetables, assetPath("BusstopPoleTimetable", operator), &odptPoleTimetables); err == nil {
+		data.timetables = newPoleTimetables(odptPoleTimetables)
+		dates := make([]string, 0, len(odptPoleTimetables))
+		for _, odptTimetable := range odptPoleTimetables {
+			dates = append(dates, odptTimetable.Date)
+		}
+		data.datasets["BusstopPoleTimetable"] = newDatasetInfo("BusstopPoleTimetable", dates)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+
+	// 時刻表はgtfs-exportでのみ使い、ファイルも大きいため、起動時はファイルがあることだけを確かめる
+	// /operators などで概要が必要になったときに一度だけ読み込む
+	busTimetableFile := assetPath("BusTimetable", operator)
+	if _, err := fs.Stat(timetables, busTimetableFile); err == nil {
+		data.busTimetable = &lazyDatasetInfo{load: func() *DatasetInfo {
+			var busTimetables []struct {
+				Date string `json:"dc:date"`
+			}
+			if err := readODPTAsset(timetables, busTimetableFile, &busTimetables); err != nil {
+				log.Printf("Error loading BusTimetable summary for %s: %v", operator.ID, err)
+				return nil
+			}
+			dates := make([]string, 0, len(busTimetables))
+			for _, timetable := range busTimetables {
+				dates = append(dates, timetable.Date)
+			}
+			return newDatasetInfo("BusTimetable", dates)
+		}}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+
+	return data, errs
+}
+
+// レコードのdc:dateからデータファイルの概要を作る。versionは最も新しいdc:date
+func newDatasetInfo(dataType string, dates []string) *DatasetInfo {
+	info := &DatasetInfo{Type: dataType, Records: len(dates)}
+	for _, date := range dates {
+		// dc:dateはすべて同じ形式のISO 8601のため文字列で比較できる
+		if date > info.Version {
+			info.Version = date
+		}
+	}
+	return info
+}
+
+// 事業者のバス停インデックスを返す。データファイルがない場合はfs.ErrNotExistを含むエラーを返す
+func (d *staticData) busstops(operator string) (*busstopIndex, error) {
+	data := d.operatorData[operator]
+	if data == nil {
+		return nil, fmt.Errorf("unknown operator %s: %w", operator, fs.ErrNotExist)
+	}
+	return data.busstops, data.busstopsErr
+}
+
+// 事業者の親のバス停を返す。バス停データがない場合はfs.ErrNotExistを含むエラーを返す
+func (d *staticData) parentBusstops(operator string) (*parentBusstopIndex, error) {
+	data := d.operatorData[operator]
+	if data == nil {
+		return nil, fmt.Errorf("unknown operator %s: %w", operator, fs.ErrNotExist)
+	}
+	return data.parents, data.busstopsErr
+}
+
+// 事業者の系統データを返す。データファイルがない場合はfs.ErrNotExistを含むエラーを返す
+func (d *staticData) busroutePatterns(operator string) ([]ODPTBusroutePattern, error) {
+	data := d.operatorData[operator]
+	if data == nil {
+		return nil, fmt.Errorf("unknown operator %s: %w", operator, fs.ErrNotExist)
+	}
+	return data.patterns, data.patternsErr
+}
+
+// sameAsからバス停の概要を引くマップを返す。バス停データがない場合はnil
+func (d *staticData) busstopPoleSummaries(operator string) map[string]*BusstopPoleSummary {
+	if data := d.operatorData[operator]; data != nil {
+		return data.summaries
+	}
+	return nil
+}
+
+// 系統IDから車両情報の加工に使う系統データを引くマップを返す。系統データがない場合はnil
+func (d *staticData) routePatterns(operator string) map[string]*routePattern {
+	if data := d.operatorData[operator]; data != nil {
+		return data.routePatterns
+	}
+	return nil
+}
+
+// 標柱ごとの時刻表を返す。標柱時刻表データがない場合はnil
+func (d *staticData) poleTimetables(operator string) poleTimetables {
+	if data := d.operatorData[operator]; data != nil {
+		return data.timetables
+	}
+	return nil
+}
+
+// sameAsから標柱と、標柱のデータを持つ事業者を引く。見つからない場合はnil
+func (d *staticData) lookupBusstopPole(sameAs string) (*Operator, *BusstopPoleSummary) {
+	for i := range d.registry {
+		operator := &d.registry[i]
+		if summary := d.busstopPoleSummaries(operator.ID)[sameAs]; summary != nil {
+			return operator, summary
+		}
+	}
+	return nil, nil
+}
+
+// 事業者のデータファイルの概要をdatasetTypesの順に返す
+// loadがfalseの場合、まだ読み込んでいない時刻表の概要は含めない
+func (d *staticData) datasets(operator string, load bool) []DatasetInfo {
+	data := d.operatorData[operator]
+	if data == nil {
+		return nil
+	}
+	datasets := make([]DatasetInfo, 0, len(datasetTypes))
+	for _, dataType := range datasetTypes {
+		info := data.datasets[dataType]
+		if dataType == "BusTimetable" && data.busTimetable != nil {
+			if load {
+				info = data.busTimetable.get()
+			} else {
+				info = data.busTimetable.loaded()
+			}
+		}
+		if info != nil {
+			datasets = append(datasets, *info)
+		}
+	}
+	return datasets
+}
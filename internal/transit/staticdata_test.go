@@ -0,0 +1,40 @@
+package transit
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOperatorDataCountsBusTimetableLazily(t *testing.T) {
+	operator := &Operator{ID: testOperator, AssetName: "Toei"}
+	timetables := fstest.MapFS{
+		"timetables/odpt_BusTimetable_Toei.json": {Data: []byte(`[
+			{"owl:sameAs": "t1", "dc:date": "2025-11-28T03:00:00+09:00"},
+			{"owl:sameAs": "t2", "dc:date": "2025-12-01T03:09:30+09:00"}
+		]`)},
+	}
+	static := &staticData{operatorData: make(map[string]*operatorData)}
+
+	data, errs := loadOperatorData(fstest.MapFS{}, timetables, operator)
+	require.Empty(t, errs)
+	require.NotNil(t, data.busTimetable)
+	static.operatorData[operator.ID] = data
+
+	// 読み込む前はscrapeに出さない
+	assert.Empty(t, static.datasets(operator.ID, false))
+
+	want := []DatasetInfo{{Type: "BusTimetable", Records: 2, Version: "2025-12-01T03:09:30+09:00"}}
+	assert.Equal(t, want, static.datasets(operator.ID, true))
+	assert.Equal(t, want, static.datasets(operator.ID, false))
+}
+
+func TestLoadOperatorDataWithoutBusTimetable(t *testing.T) {
+	operator := &Operator{ID: testOperator, AssetName: "Toei"}
+	data, errs := loadOperatorData(fstest.MapFS{}, fstest.MapFS{}, operator)
+	assert.Empty(t, errs)
+	assert.Nil(t, data.busTimetable)
+	assert.Empty(t, data.datasets)
+}
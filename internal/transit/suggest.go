@@ -0,0 +1,218 @@
+package transit
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 候補の数の既定値と上限
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 50
+)
+
+// BusstopSuggestion /busstoppole/suggest のレスポンスの1件。同じ名前の標柱をまとめる
+type BusstopSuggestion struct {
+	Title  string               `json:"title"`
+	Titles map[string]string    `json:"titles,omitempty"` // lang=allの場合の多言語マップ
+	Kana   string               `json:"kana,omitempty"`
+	Poles  []BusstopPoleSummary `json:"poles"`
+}
+
+// busstopName 正規化すると同じになるバス停名。標柱はbyTitleで引く
+type busstopName struct {
+	key      string // 正規化したバス停名
+	title    string // 最初に現れた標柱のバス停名
+	titleMap map[string]string
+	kana     string
+}
+
+// namePrefix 前方一致検索の索引の1件。keyの昇順に並べる
+type namePrefix struct {
+	key  string // 正規化したバス停名・読み・ローマ字・英語名のいずれか
+	name int    // namesの位置
+}
+
+// バス停名・読み・ローマ字・英語名の前方一致の索引を作る
+func (index *busstopIndex) buildNameIndex() {
+	names := make(map[string]int)
+	seen := make(map[namePrefix]bool)
+	for i, busstop := range index.busstops {
+		keys := index.keys[i]
+		if keys.title == "" {
+			continue
+		}
+
+		n, ok := names[keys.title]
+		if !ok {
+			n = len(index.names)
+			names[keys.title] = n
+			index.names = append(index.names, busstopName{key: keys.title, title: busstop.Title, titleMap: busstop.titleMap, kana: busstop.Kana})
+		}
+
+		for _, key := range []string{keys.title, keys.kana, keys.romaji, keys.en} {
+			prefix := namePrefix{key: key, name: n}
+			if key == "" || seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			index.prefixes = append(index.prefixes, prefix)
+		}
+	}
+
+	sort.Slice(index.prefixes, func(i, j int) bool {
+		return index.prefixes[i].key < index.prefixes[j].key
+	})
+}
+
+// 検索語で始まる索引の範囲を返す
+func (index *busstopIndex) prefixRange(text string) []namePrefix {
+	start := sort.Search(len(index.prefixes), func(i int) bool {
+		return index.prefixes[i].key >= text
+	})
+	end := start
+	for end < len(index.prefixes) && strings.HasPrefix(index.prefixes[end].key, text) {
+		end++
+	}
+	return index.prefixes[start:end]
+}
+
+// suggestCandidate 候補のバス停名と並べ替えの基準
+type suggestCandidate struct {
+	index *busstopIndex
+	name  int
+	exact bool // 検索語といずれかの索引が完全一致
+	key   int  // 一致した索引の最も短い長さ
+}
+
+// 検索語で始まるバス停名の候補を集める。candidatesは正規化したバス停名ごとにまとめる
+func (index *busstopIndex) suggest(query *titleQuery, candidates map[string]*suggestCandidate, order *[]string) {
+	add := func(prefixes []namePrefix, text string) {
+		for _, prefix := range prefixes {
+			title := index.names[prefix.name].key
+			candidate, ok := candidates[title]
+			if !ok {
+				candidate = &suggestCandidate{index: index, name: prefix.name, key: len(prefix.key)}
+				candidates[title] = candidate
+				*order = append(*order, title)
+			}
+			candidate.exact = candidate.exact || prefix.key == text
+			candidate.key = min(candidate.key, len(prefix.key))
+		}
+	}
+
+	add(index.prefixRange(query.text), query.text)
+	if query.romaji != "" && query.romaji != query.text {
+		add(index.prefixRange(query.romaji), query.romaji)
+	}
+}
+
+// バス停名の入力補完の候補を返すハンドラー
+func GetBusstopPoleSuggestions(w http.ResponseWriter, r *http.Request) {
+	// クエリパラメータからoperatorを取得 (カンマ区切りで複数指定可)
+	operators, err := parseOperators(r.URL.Query().Get("operator"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := newTitleQuery(r.URL.Query().Get("q"))
+	if query == nil {
+		http.Error(w, "q parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"), defaultSuggestLimit, maxSuggestLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 名称の言語を取得 (langパラメータまたはAccept-Language)
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	// 複数の事業者で同じ名前のバス停は1件にまとめる
+	static := getStaticData()
+	candidates := make(map[string]*suggestCandidate)
+	var order []string
+	for _, operator := range operators {
+		index, err := static.busstops(operator)
+		if err != nil {
+			// バス停データのない事業者は候補なしとして扱う
+			continue
+		}
+		index.suggest(query, candidates, &order)
+	}
+
+	// 完全一致を先に、次に短い名前から並べる
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := candidates[order[i]], candidates[order[j]]
+		if a.exact != b.exact {
+			return a.exact
+		}
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return order[i] < order[j]
+	})
+	if len(order) > limit {
+		order = order[:limit]
+	}
+
+	suggestions := make([]BusstopSuggestion, 0, len(order))
+	for _, title := range order {
+		candidate := candidates[title]
+		name := candidate.index.names[candidate.name]
+		suggestion := BusstopSuggestion{Kana: name.kana}
+		suggestion.Title, suggestion.Titles = lang.localize(name.title, name.titleMap)
+		// 他の事業者の同じ名前の標柱も加える
+		for _, operator := range operators {
+			index, err := static.busstops(operator)
+			if err != nil {
+				continue
+			}
+			for _, i := range index.byTitle[title] {
+				busstop := index.busstops[i]
+				pole := BusstopPoleSummary{
+					SameAs: busstop.SameAs,
+					Lat:    busstop.Lat,
+					Long:   busstop.Long,
+				}
+				pole.Title, pole.Titles = lang.localize(busstop.Title, busstop.titleMap)
+				suggestion.Poles = append(suggestion.Poles, pole)
+			}
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(suggestions); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	logResult(r.Context(), operators, len(suggestions))
+}
+
+// limitパラメータを解析する。省略時は既定値、上限を超える場合は上限にする
+func parseLimit(value string, defaultLimit, maxLimit int) (int, error) {
+	if value == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid limit parameter")
+	}
+	return min(limit, maxLimit), nil
+}
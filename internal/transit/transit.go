@@ -0,0 +1,1028 @@
+// Package transit はローカルサーバー (main.go) とVercelの関数 (api/) が共有する、
+// ODPT APIの取得・変換とラッパーAPIのハンドラーの実装です。
+// どちらもこのパッケージのハンドラーをルーティングするだけにし、修正が両方に反映されるようにします。
+package transit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"transport-realtime/assets"
+)
+
+// Bus レスポンスの構造体
+type Bus struct {
+	ID                  string     `json:"id"`
+	Type                string     `json:"type"`
+	Date                time.Time  `json:"date"`
+	Note                string     `json:"note"`
+	Operator            string     `json:"operator"`
+	BusNumber           string     `json:"busNumber"`
+	BusTimetable        string     `json:"busTimetable,omitempty"`
+	ToBusstopPole       string     `json:"toBusstopPole,omitempty"`
+	BusroutePattern     string     `json:"busroutePattern,omitempty"`
+	FromBusstopPole     string     `json:"fromBusstopPole,omitempty"`
+	FromBusstopPoleTime *time.Time `json:"fromBusstopPoleTime,omitempty"`
+	StartingBusstopPole string     `json:"startingBusstopPole,omitempty"`
+	TerminalBusstopPole string     `json:"terminalBusstopPole,omitempty"`
+
+	// expandパラメータ指定時に付与されるバス停の詳細
+	FromBusstopPoleDetail     *BusstopPoleSummary `json:"fromBusstopPoleDetail,omitempty"`
+	ToBusstopPoleDetail       *BusstopPoleSummary `json:"toBusstopPoleDetail,omitempty"`
+	StartingBusstopPoleDetail *BusstopPoleSummary `json:"startingBusstopPoleDetail,omitempty"`
+	TerminalBusstopPoleDetail *BusstopPoleSummary `json:"terminalBusstopPoleDetail,omitempty"`
+
+	// 前後のバス停と経路形状から推定した現在位置
+	EstimatedPosition *VehiclePosition `json:"estimatedPosition,omitempty"`
+}
+
+// BusstopPoleSummary 車両情報に埋め込むバス停の概要
+type BusstopPoleSummary struct {
+	SameAs string            `json:"sameAs"`
+	Title  string            `json:"title"`
+	Titles map[string]string `json:"titles,omitempty"` // lang=allの場合の多言語マップ
+	Lat    float64           `json:"lat"`
+	Long   float64           `json:"long"`
+
+	titleMap map[string]string // 言語タグごとの名称
+}
+
+// ODPTのレスポンス構造体
+type ODPTBus struct {
+	ID                  string `json:"@id"`
+	Type                string `json:"@type"`
+	Date                string `json:"dc:date"`
+	Context             string `json:"@context"`
+	Valid               string `json:"dct:valid"`
+	Note                string `json:"odpt:note"`
+	SameAs              string `json:"owl:sameAs"`
+	Busroute            string `json:"odpt:busroute"`
+	Operator            string `json:"odpt:operator"`
+	BusNumber           string `json:"odpt:busNumber"`
+	Frequency           int    `json:"odpt:frequency"`
+	BusTimetable        string `json:"odpt:busTimetable"`
+	ToBusstopPole       string `json:"odpt:toBusstopPole"`
+	BusroutePattern     string `json:"odpt:busroutePattern"`
+	FromBusstopPole     string `json:"odpt:fromBusstopPole"`
+	FromBusstopPoleTime string `json:"odpt:fromBusstopPoleTime"`
+	StartingBusstopPole string `json:"odpt:startingBusstopPole"`
+	TerminalBusstopPole string `json:"odpt:terminalBusstopPole"`
+}
+
+// BusstopPole レスポンスの構造体
+type BusstopPole struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	SameAs   string            `json:"sameAs"`
+	Date     string            `json:"date"`
+	Title    string            `json:"title"`
+	Titles   map[string]string `json:"titles,omitempty"` // lang=allの場合の多言語マップ
+	Kana     string            `json:"kana,omitempty"`
+	Long     float64           `json:"long"`
+	Lat      float64           `json:"lat"`
+	Operator []string          `json:"operator"`
+
+	// 近傍検索時の検索地点からの距離 (m)
+	Distance *float64 `json:"distance,omitempty"`
+
+	titleMap map[string]string // 言語タグごとの名称
+}
+
+// ODPTのバス停データ構造体
+type ODPTBusstopPole struct {
+	ID       string      `json:"@id"`
+	Type     string      `json:"@type"`
+	Title    interface{} `json:"title"`
+	Date     string      `json:"dc:date"`
+	DCTitle  string      `json:"dc:title"`
+	Long     float64     `json:"geo:long"`
+	Lat      float64     `json:"geo:lat"`
+	Kana     string      `json:"odpt:kana"`
+	Note     string      `json:"odpt:note"`
+	SameAs   string      `json:"owl:sameAs"`
+	Operator []string    `json:"odpt:operator"`
+}
+
+// BusroutePattern レスポンスの構造体
+type BusroutePattern struct {
+	ID               string                 `json:"id"`
+	Type             string                 `json:"type"`
+	SameAs           string                 `json:"sameAs"`
+	Date             string                 `json:"date"`
+	Title            string                 `json:"title"`
+	Titles           map[string]string      `json:"titles,omitempty"` // lang=allの場合の多言語マップ
+	Operator         string                 `json:"operator"`
+	Busroute         string                 `json:"busroute,omitempty"`
+	Pattern          string                 `json:"pattern,omitempty"`
+	Direction        string                 `json:"direction,omitempty"`
+	Region           json.RawMessage        `json:"region,omitempty"`
+	BusstopPoleOrder []BusstopPoleOrderItem `json:"busstopPoleOrder,omitempty"`
+}
+
+// BusstopPoleOrderItem 系統内の停留所(標柱)の順序
+type BusstopPoleOrderItem struct {
+	Note        string `json:"note"`
+	Index       int    `json:"index"`
+	BusstopPole string `json:"busstopPole"`
+}
+
+// ODPTの系統データ構造体
+type ODPTBusroutePattern struct {
+	ID               string                     `json:"@id"`
+	Type             string                     `json:"@type"`
+	Date             string                     `json:"dc:date"`
+	Title            string                     `json:"dc:title"`
+	Kana             string                     `json:"odpt:kana"`
+	Note             string                     `json:"odpt:note"`
+	SameAs           string                     `json:"owl:sameAs"`
+	Operator         string                     `json:"odpt:operator"`
+	Busroute         string                     `json:"odpt:busroute"`
+	Pattern          string                     `json:"odpt:pattern"`
+	Direction        string                     `json:"odpt:direction"`
+	Region           json.RawMessage            `json:"ug:region"`
+	BusstopPoleOrder []ODPTBusstopPoleOrderItem `json:"odpt:busstopPoleOrder"`
+}
+
+// ODPTの停留所(標柱)順序データ構造体
+type ODPTBusstopPoleOrderItem struct {
+	Note        string `json:"odpt:note"`
+	Index       int    `json:"odpt:index"`
+	BusstopPole string `json:"odpt:busstopPole"`
+}
+
+// ODPTのバス時刻表データ構造体
+type ODPTBusTimetable struct {
+	ID                 string                       `json:"@id"`
+	Type               string                       `json:"@type"`
+	Date               string                       `json:"dc:date"`
+	Title              string                       `json:"dc:title"`
+	SameAs             string                       `json:"owl:sameAs"`
+	Operator           string                       `json:"odpt:operator"`
+	Busroute           string                       `json:"odpt:busroute"`
+	BusroutePattern    string                       `json:"odpt:busroutePattern"`
+	Calendar           string                       `json:"odpt:calendar"`
+	BusTimetableObject []ODPTBusTimetableObjectItem `json:"odpt:busTimetableObject"`
+}
+
+// ODPTのバス時刻表の停車時刻データ構造体
+type ODPTBusTimetableObjectItem struct {
+	Index           int    `json:"odpt:index"`
+	BusstopPole     string `json:"odpt:busstopPole"`
+	ArrivalTime     string `json:"odpt:arrivalTime"`
+	DepartureTime   string `json:"odpt:departureTime"`
+	DestinationSign string `json:"odpt:destinationSign"`
+	IsMidnight      bool   `json:"odpt:isMidnight"`
+	CanGetOn        *bool  `json:"odpt:canGetOn"`
+	CanGetOff       *bool  `json:"odpt:canGetOff"`
+	Note            string `json:"odpt:note"`
+}
+
+// ODPTの標柱時刻表データ構造体
+type ODPTBusstopPoleTimetable struct {
+	ID                         string                               `json:"@id"`
+	Type                       string                               `json:"@type"`
+	Date                       string                               `json:"dc:date"`
+	Title                      string                               `json:"dc:title"`
+	SameAs                     string                               `json:"owl:sameAs"`
+	Operator                   string                               `json:"odpt:operator"`
+	Busroute                   string                               `json:"odpt:busroute"`
+	BusstopPole                string                               `json:"odpt:busstopPole"`
+	Calendar                   string                               `json:"odpt:calendar"`
+	BusstopPoleTimetableObject []ODPTBusstopPoleTimetableObjectItem `json:"odpt:busstopPoleTimetableObject"`
+}
+
+// ODPTの標柱時刻表の1便分のデータ構造体
+type ODPTBusstopPoleTimetableObjectItem struct {
+	ArrivalTime            string `json:"odpt:arrivalTime"`
+	DepartureTime          string `json:"odpt:departureTime"`
+	DestinationBusstopPole string `json:"odpt:destinationBusstopPole"`
+	DestinationSign        string `json:"odpt:destinationSign"`
+	BusroutePattern        string `json:"odpt:busroutePattern"`
+	IsMidnight             bool   `json:"odpt:isMidnight"`
+	CanGetOn               *bool  `json:"odpt:canGetOn"`
+	Note                   string `json:"odpt:note"`
+}
+
+// ODPT APIのベースURL。環境変数 ODPT_API_BASE_URL で変更できる (cmd/fakeodptなど)
+var odptAPIBaseURL = odptBaseURL()
+
+const defaultODPTAPIBaseURL = "https://api-public.odpt.org/api/v4"
+
+func odptBaseURL() string {
+	if baseURL := os.Getenv("ODPT_API_BASE_URL"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	return defaultODPTAPIBaseURL
+}
+
+// ODPT APIのコンシューマーキー。環境変数 ODPT_CONSUMER_KEY から取得する
+// 以前のVercelの関数が使っていた odpt_consumer_key も、設定済みの環境のために受け付ける
+func odptConsumerKey() string {
+	if consumerKey := os.Getenv("ODPT_CONSUMER_KEY"); consumerKey != "" {
+		return consumerKey
+	}
+	return os.Getenv("odpt_consumer_key")
+}
+
+// ODPT APIへのリクエストに使うHTTPクライアント。接続を使い回すため共有する
+var odptHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// CORSミドルウェア
+func CORSMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// ODPT APIのodpt:Busにそのまま中継するフィルタパラメータ
+var busFilterParams = []string{
+	"busNumber",
+	"busTimetable",
+	"toBusstopPole",
+	"busroutePattern",
+	"fromBusstopPole",
+	"startingBusstopPole",
+	"terminalBusstopPole",
+}
+
+// バス位置情報を取得するハンドラー
+func GetBusVehicleLocation(w http.ResponseWriter, r *http.Request) {
+	// クエリパラメータからoperatorを取得 (カンマ区切りで複数指定可)
+	operators, err := parseRealtimeOperators(r.URL.Query().Get("operator"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// オプションのフィルタパラメータを取得
+	filters := url.Values{}
+	for _, param := range busFilterParams {
+		if value := r.URL.Query().Get(param); value != "" {
+			filters.Add("odpt:"+param, value)
+		}
+	}
+
+	// 展開するバス停フィールドを取得
+	expand, err := parseExpand(r.URL.Query().Get("expand"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 表示範囲を取得
+	bbox, err := parseBoundingBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 出力形式を取得 (format=geojson またはAccept: application/geo+json)
+	geoJSON, err := wantsGeoJSON(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 名称の言語を取得 (langパラメータまたはAccept-Language)
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	static := getStaticData()
+	buses := make([]Bus, 0)
+	snapshots := make([]*odptBusSnapshot, 0, len(operators))
+	for _, operator := range operators {
+		// ODPT APIから車両情報を取得 (同じクエリはキャッシュを共有し、障害時は最後に取得できたデータを使う)
+		snapshot, upstreamErr := sharedBusCache.get(r.Context(), operator, filters)
+		if upstreamErr != nil {
+			http.Error(w, upstreamErr.message, upstreamErr.status)
+			return
+		}
+		snapshots = append(snapshots, snapshot)
+
+		// ラッパーAPIのレスポンス形式に変換
+		operatorBuses := convertODPTBuses(snapshot.buses)
+
+		// バス停の展開と現在位置の推定
+		enrichBuses(operatorBuses, static.busstopPoleSummaries(operator), static.routePatterns(operator), expand, time.Now())
+
+		buses = append(buses, operatorBuses...)
+	}
+
+	// 表示範囲内の車両に絞り込む
+	if bbox != nil {
+		buses = filterBusesInBoundingBox(buses, bbox)
+	}
+
+	// 展開したバス停の名称を指定された言語にする
+	if lang != nil {
+		for i := range buses {
+			buses[i] = buses[i].localized(lang)
+		}
+	}
+
+	// データの鮮度
+	setSnapshotHeaders(w, snapshots)
+	observeReturnedVehicles(buses)
+
+	// JSONレスポンスを返す
+	if geoJSON {
+		err = writeGeoJSON(w, busFeatures(buses))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(buses)
+	}
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	logResult(r.Context(), operators, len(buses))
+}
+
+// upstreamError ODPT APIの呼び出しに失敗した際にクライアントへ返すステータスとメッセージ
+type upstreamError struct {
+	status    int
+	message   string
+	temporary bool // タイムアウトや5xxなど、時間をおけば回復する見込みのある失敗
+}
+
+// ODPT APIのodpt:Busから事業者の車両情報を取得する
+func fetchODPTBuses(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+	// ODPT APIにリクエストを送信
+	apiURL := fmt.Sprintf("%s/odpt:Bus", odptAPIBaseURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		log.Printf("Error creating request: %v", err)
+		return nil, &upstreamError{http.StatusInternalServerError, "Internal server error", false}
+	}
+
+	// パラメータを設定
+	q := url.Values{}
+	q.Add("odpt:operator", operator)
+
+	// オプションパラメータを追加
+	for key, values := range filters {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
+
+	// 環境変数からコンシューマーキーを取得
+	if consumerKey := odptConsumerKey(); consumerKey != "" {
+		q.Add("acl:consumerKey", consumerKey)
+	}
+
+	req.URL.RawQuery = q.Encode()
+
+	// リクエストを実行 (URLにはコンシューマーキーが含まれるため、ログにはlogUpstreamRequestで伏せて出す)
+	start := time.Now()
+	resp, err := odptHTTPClient.Do(req)
+	if err != nil {
+		logUpstreamRequest(ctx, req.URL, operator, 0, time.Since(start), 0, err)
+		if os.IsTimeout(err) {
+			return nil, &upstreamError{http.StatusGatewayTimeout, "External API timed out", true}
+		}
+		return nil, &upstreamError{http.StatusBadGateway, "Error requesting external API", true}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logUpstreamRequest(ctx, req.URL, operator, resp.StatusCode, time.Since(start), 0, nil)
+		captureODPTResponse(operator, filters, resp.StatusCode, nil)
+		// 上流の4xx (コンシューマーキーの誤りや利用上限など) はクライアントの誤りではないため、すべて502で返す
+		message := fmt.Sprintf("External API returned status: %d", resp.StatusCode)
+		temporary := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, &upstreamError{http.StatusBadGateway, message, temporary}
+	}
+
+	// レスポンスを読み取り
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logUpstreamRequest(ctx, req.URL, operator, resp.StatusCode, time.Since(start), 0, err)
+		return nil, &upstreamError{http.StatusBadGateway, "Error reading response", true}
+	}
+	captureODPTResponse(operator, filters, resp.StatusCode, body)
+
+	// ODPTのレスポンスをパース
+	var odptBuses []ODPTBus
+	if err := json.Unmarshal(body, &odptBuses); err != nil {
+		logUpstreamRequest(ctx, req.URL, operator, resp.StatusCode, time.Since(start), 0, err)
+		return nil, &upstreamError{http.StatusBadGateway, "Error parsing response", true}
+	}
+
+	logUpstreamRequest(ctx, req.URL, operator, resp.StatusCode, time.Since(start), len(odptBuses), nil)
+	return odptBuses, nil
+}
+
+// ODPTの車両情報をラッパーAPIのレスポンス形式に変換する
+func convertODPTBuses(odptBuses []ODPTBus) []Bus {
+	buses := make([]Bus, 0, len(odptBuses))
+	for _, odptBus := range odptBuses {
+		bus := Bus{
+			ID:                  odptBus.ID,
+			Type:                odptBus.Type,
+			Note:                odptBus.Note,
+			Operator:            odptBus.Operator,
+			BusNumber:           odptBus.BusNumber,
+			BusTimetable:        odptBus.BusTimetable,
+			ToBusstopPole:       odptBus.ToBusstopPole,
+			BusroutePattern:     odptBus.BusroutePattern,
+			FromBusstopPole:     odptBus.FromBusstopPole,
+			StartingBusstopPole: odptBus.StartingBusstopPole,
+			TerminalBusstopPole: odptBus.TerminalBusstopPole,
+		}
+
+		// 日時をパース
+		if parsedDate, err := time.Parse(time.RFC3339, odptBus.Date); err == nil {
+			bus.Date = parsedDate
+		}
+
+		if odptBus.FromBusstopPoleTime != "" {
+			if parsedTime, err := time.Parse(time.RFC3339, odptBus.FromBusstopPoleTime); err == nil {
+				bus.FromBusstopPoleTime = &parsedTime
+			}
+		}
+
+		buses = append(buses, bus)
+	}
+	return buses
+}
+
+// バス停IDをバス停データと突き合わせて展開し、前後のバス停と経路形状から現在位置を推定する
+func enrichBuses(buses []Bus, busstops map[string]*BusstopPoleSummary, patterns map[string]*routePattern, expand map[string]bool, now time.Time) {
+	if len(expand) > 0 {
+		expandBusstopPoles(buses, busstops, expand)
+	}
+	for i := range buses {
+		buses[i].EstimatedPosition = estimateBusPosition(buses[i], busstops, patterns, now)
+	}
+}
+
+// 推定位置 (なければ展開済みの直近のバス停の位置) が表示範囲内にある車両に絞り込む
+func filterBusesInBoundingBox(buses []Bus, bbox *boundingBox) []Bus {
+	filtered := make([]Bus, 0, len(buses))
+	for _, bus := range buses {
+		switch {
+		case bus.EstimatedPosition != nil:
+			if !bbox.contains(bus.EstimatedPosition.Lat, bus.EstimatedPosition.Long) {
+				continue
+			}
+		case bus.FromBusstopPoleDetail != nil:
+			if !bbox.contains(bus.FromBusstopPoleDetail.Lat, bus.FromBusstopPoleDetail.Long) {
+				continue
+			}
+		default:
+			// 位置が分からない車両は範囲外として扱う
+			continue
+		}
+		filtered = append(filtered, bus)
+	}
+	return filtered
+}
+
+// バス停情報を取得するハンドラー
+func GetBusstopPole(w http.ResponseWriter, r *http.Request) {
+	// クエリパラメータからoperatorを取得 (カンマ区切りで複数指定可)
+	operators, err := parseOperators(r.URL.Query().Get("operator"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// オプションのフィルタパラメータを取得
+	filterID := r.URL.Query().Get("id")
+	titleQuery := newTitleQuery(r.URL.Query().Get("title"))
+	filterSameAs := r.URL.Query().Get("sameAs")
+
+	// 近傍検索のパラメータを取得
+	nearby, err := parseNearbyQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 表示範囲を取得
+	bbox, err := parseBoundingBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 出力形式を取得 (format=geojson またはAccept: application/geo+json)
+	geoJSON, err := wantsGeoJSON(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 名称の言語を取得 (langパラメータまたはAccept-Language)
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	static := getStaticData()
+	busstops := make([]BusstopPole, 0)
+	ranks := make([]int, 0) // バス停名の検索時のbusstopsの一致の順位
+	for _, operator := range operators {
+		// メモリ上のバス停インデックスを取得
+		index, err := static.busstops(operator)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Error reading file: %v", err)
+				http.Error(w, fmt.Sprintf("Data not found for operator: %s", operator), http.StatusNotFound)
+				return
+			}
+			log.Printf("Error loading busstop data: %v", err)
+			http.Error(w, "Error parsing data", http.StatusInternalServerError)
+			return
+		}
+
+		// フィルタリング処理
+		accept := func(i int) bool {
+			busstop := index.busstops[i]
+			if filterID != "" && busstop.ID != filterID {
+				return false
+			}
+			if titleQuery != nil && titleQuery.match(index.keys[i]) == titleMatchNone {
+				return false
+			}
+			if filterSameAs != "" && busstop.SameAs != filterSameAs {
+				return false
+			}
+			if bbox != nil && !bbox.contains(busstop.Lat, busstop.Long) {
+				return false
+			}
+			return true
+		}
+
+		switch {
+		case nearby != nil:
+			// 検索地点から近い順に返す
+			for _, match := range index.grid.nearby(nearby.lat, nearby.long, nearby.radius, nearby.limit, accept) {
+				busstop := index.busstops[match.index]
+				distance := math.Round(match.distance*10) / 10
+				busstop.Distance = &distance
+				busstops = append(busstops, busstop)
+			}
+		case bbox != nil:
+			for _, i := range index.grid.within(bbox, accept) {
+				busstops = append(busstops, index.busstops[i])
+				ranks = append(ranks, titleQuery.rank(index.keys[i]))
+			}
+		case filterSameAs != "" || filterID != "":
+			// sameAsまたはIDが指定された場合は索引から引く
+			if i, ok := index.lookup(filterSameAs, filterID); ok && accept(i) {
+				busstops = append(busstops, index.busstops[i])
+				ranks = append(ranks, titleQuery.rank(index.keys[i]))
+			}
+		default:
+			for i := range index.busstops {
+				if accept(i) {
+					busstops = append(busstops, index.busstops[i])
+					ranks = append(ranks, titleQuery.rank(index.keys[i]))
+				}
+			}
+		}
+	}
+
+	// バス停名で検索した場合は完全一致、前方一致、部分一致の順に返す (近傍検索は距離順のまま)
+	if titleQuery != nil && nearby == nil {
+		sortByRank(busstops, ranks)
+	}
+
+	// 複数事業者の近傍検索結果を距離順にまとめる
+	if nearby != nil && len(operators) > 1 {
+		sort.SliceStable(busstops, func(i, j int) bool {
+			return *busstops[i].Distance < *busstops[j].Distance
+		})
+		if nearby.limit > 0 && len(busstops) > nearby.limit {
+			busstops = busstops[:nearby.limit]
+		}
+	}
+
+	for i := range busstops {
+		busstops[i] = busstops[i].localized(lang)
+	}
+
+	// JSONレスポンスを返す
+	if geoJSON {
+		err = writeGeoJSON(w, busstopFeatures(busstops))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(busstops)
+	}
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	logResult(r.Context(), operators, len(busstops))
+}
+
+// 系統情報を取得するハンドラー
+func GetBusroutePattern(w http.ResponseWriter, r *http.Request) {
+	// クエリパラメータからoperatorを取得
+	operator := r.URL.Query().Get("operator")
+
+	if operator == "" {
+		http.Error(w, "operator parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// オプションのフィルタパラメータを取得
+	filterSameAs := r.URL.Query().Get("sameAs")
+	filterBusroute := r.URL.Query().Get("busroute")
+	filterTitle := r.URL.Query().Get("title")
+
+	// 登録されている事業者か確認
+	if lookupOperator(operator) == nil {
+		http.Error(w, fmt.Sprintf("unknown operator: %s", operator), http.StatusBadRequest)
+		return
+	}
+
+	// 出力形式を取得 (format=geojson またはAccept: application/geo+json)
+	geoJSON, err := wantsGeoJSON(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 名称の言語を取得 (lang またはAccept-Language)
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	// メモリ上の系統データを取得
+	odptPatterns, err := getStaticData().busroutePatterns(operator)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading file: %v", err)
+			http.Error(w, fmt.Sprintf("Data not found for operator: %s", operator), http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading busroute pattern data: %v", err)
+		http.Error(w, "Error parsing data", http.StatusInternalServerError)
+		return
+	}
+
+	// ラッパーAPIのレスポンス形式に変換とフィルタリング
+	patterns := make([]BusroutePattern, 0, len(odptPatterns))
+	for _, odptPattern := range odptPatterns {
+		// フィルタリング処理
+		if filterSameAs != "" && odptPattern.SameAs != filterSameAs {
+			continue
+		}
+		if filterBusroute != "" && odptPattern.Busroute != filterBusroute {
+			continue
+		}
+		if filterTitle != "" && !strings.Contains(odptPattern.Title, filterTitle) {
+			continue
+		}
+
+		// 停留所(標柱)の順序を変換
+		poleOrder := make([]BusstopPoleOrderItem, 0, len(odptPattern.BusstopPoleOrder))
+		for _, item := range odptPattern.BusstopPoleOrder {
+			poleOrder = append(poleOrder, BusstopPoleOrderItem{
+				Note:        item.Note,
+				Index:       item.Index,
+				BusstopPole: item.BusstopPole,
+			})
+		}
+
+		pattern := BusroutePattern{
+			ID:               odptPattern.ID,
+			Type:             odptPattern.Type,
+			SameAs:           odptPattern.SameAs,
+			Date:             odptPattern.Date,
+			Title:            odptPattern.Title,
+			Operator:         odptPattern.Operator,
+			Busroute:         odptPattern.Busroute,
+			Pattern:          odptPattern.Pattern,
+			Direction:        odptPattern.Direction,
+			Region:           odptPattern.Region,
+			BusstopPoleOrder: poleOrder,
+		}
+
+		patterns = append(patterns, pattern.localized(lang))
+	}
+
+	// JSONレスポンスを返す
+	if geoJSON {
+		err = writeGeoJSON(w, busroutePatternFeatures(patterns))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(patterns)
+	}
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	logResult(r.Context(), []string{operator}, len(patterns))
+}
+
+// expandで指定できるバス停フィールド
+var expandableBusstopFields = []string{"fromBusstopPole", "toBusstopPole", "startingBusstopPole", "terminalBusstopPole"}
+
+// expandパラメータを解析する (例: expand=fromBusstopPole,toBusstopPole)
+// "busstopPole" を指定するとすべてのバス停フィールドを展開する
+func parseExpand(value string) (map[string]bool, error) {
+	expand := make(map[string]bool)
+	if value == "" {
+		return expand, nil
+	}
+
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if field == "busstopPole" {
+			for _, f := range expandableBusstopFields {
+				expand[f] = true
+			}
+			continue
+		}
+
+		valid := false
+		for _, f := range expandableBusstopFields {
+			if field == f {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid expand field: %s", field)
+		}
+		expand[field] = true
+	}
+
+	return expand, nil
+}
+
+// sameAsからバス停の概要を引けるようにする
+func newBusstopPoleSummaries(busstops []BusstopPole) map[string]*BusstopPoleSummary {
+	summaries := make(map[string]*BusstopPoleSummary, len(busstops))
+	for _, busstop := range busstops {
+		summaries[busstop.SameAs] = &BusstopPoleSummary{
+			SameAs:   busstop.SameAs,
+			Title:    busstop.Title,
+			Lat:      busstop.Lat,
+			Long:     busstop.Long,
+			titleMap: busstop.titleMap,
+		}
+	}
+	return summaries
+}
+
+// 車両のバス停IDをバス停データと突き合わせ、名称と座標を埋め込む
+func expandBusstopPoles(buses []Bus, summaries map[string]*BusstopPoleSummary, expand map[string]bool) {
+	for i := range buses {
+		bus := &buses[i]
+		if expand["fromBusstopPole"] {
+			bus.FromBusstopPoleDetail = summaries[bus.FromBusstopPole]
+		}
+		if expand["toBusstopPole"] {
+			bus.ToBusstopPoleDetail = summaries[bus.ToBusstopPole]
+		}
+		if expand["startingBusstopPole"] {
+			bus.StartingBusstopPoleDetail = summaries[bus.StartingBusstopPole]
+		}
+		if expand["terminalBusstopPole"] {
+			bus.TerminalBusstopPoleDetail = summaries[bus.TerminalBusstopPole]
+		}
+	}
+}
+
+// operatorパラメータを解析する。カンマ区切りで複数の事業者を指定できる
+func parseOperators(value string) ([]string, error) {
+	if value == "" {
+		return nil, errors.New("operator parameter is required")
+	}
+
+	var operators []string
+	seen := make(map[string]bool)
+	for _, operator := range strings.Split(value, ",") {
+		operator = strings.TrimSpace(operator)
+		if operator == "" || seen[operator] {
+			continue
+		}
+		// 登録されている事業者か確認 (一覧は /operators)
+		if lookupOperator(operator) == nil {
+			return nil, fmt.Errorf("unknown operator: %s", operator)
+		}
+		seen[operator] = true
+		operators = append(operators, operator)
+	}
+	if len(operators) == 0 {
+		return nil, errors.New("operator parameter is required")
+	}
+
+	return operators, nil
+}
+
+// 車両の位置情報を返すエンドポイントのoperatorパラメータを解析する
+// 登録情報でodpt:Busを提供していない事業者はエラーにする
+func parseRealtimeOperators(value string) ([]string, error) {
+	operators, err := parseOperators(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range operators {
+		if !lookupOperator(operator).Realtime {
+			return nil, fmt.Errorf("realtime vehicle data is not available for operator: %s", operator)
+		}
+	}
+	return operators, nil
+}
+
+// 近傍検索で半径もlimitも指定されなかった場合の検索半径 (m)
+const defaultNearbyRadius = 500.0
+
+// nearbyQuery バス停の近傍検索条件
+type nearbyQuery struct {
+	lat    float64
+	long   float64
+	radius float64
+	limit  int
+}
+
+// lat, lon, radius, limitパラメータを解析する。lat, lonが指定されていない場合はnilを返す
+func parseNearbyQuery(q url.Values) (*nearbyQuery, error) {
+	latStr, lonStr := q.Get("lat"), q.Get("lon")
+	radiusStr, limitStr := q.Get("radius"), q.Get("limit")
+
+	if latStr == "" && lonStr == "" {
+		if radiusStr != "" || limitStr != "" {
+			return nil, errors.New("lat and lon parameters are required for radius and limit")
+		}
+		return nil, nil
+	}
+	if latStr == "" || lonStr == "" {
+		return nil, errors.New("lat and lon parameters must be specified together")
+	}
+
+	query := &nearbyQuery{}
+	var err error
+	if query.lat, err = strconv.ParseFloat(latStr, 64); err != nil || query.lat < -90 || query.lat > 90 {
+		return nil, errors.New("invalid lat parameter")
+	}
+	if query.long, err = strconv.ParseFloat(lonStr, 64); err != nil || query.long < -180 || query.long > 180 {
+		return nil, errors.New("invalid lon parameter")
+	}
+	if radiusStr != "" {
+		if query.radius, err = strconv.ParseFloat(radiusStr, 64); err != nil || query.radius <= 0 {
+			return nil, errors.New("invalid radius parameter")
+		}
+	}
+	if limitStr != "" {
+		if query.limit, err = strconv.Atoi(limitStr); err != nil || query.limit <= 0 {
+			return nil, errors.New("invalid limit parameter")
+		}
+	}
+	if radiusStr == "" && limitStr == "" {
+		query.radius = defaultNearbyRadius
+	}
+
+	return query, nil
+}
+
+// 事業者のバス停データをassetsディレクトリから読み込む (サーバーはgetStaticDataで読み込み済みのものを使う)
+func loadODPTBusstopPoles(operator string) ([]ODPTBusstopPole, error) {
+	var odptBusstops []ODPTBusstopPole
+	if err := loadODPTAsset("BusstopPole", operator, &odptBusstops); err != nil {
+		return nil, err
+	}
+	return odptBusstops, nil
+}
+
+// 事業者の系統データをassetsディレクトリから読み込む
+func loadODPTBusroutePatterns(operator string) ([]ODPTBusroutePattern, error) {
+	var odptPatterns []ODPTBusroutePattern
+	if err := loadODPTAsset("BusroutePattern", operator, &odptPatterns); err != nil {
+		return nil, err
+	}
+	return odptPatterns, nil
+}
+
+// 事業者の時刻表データをassetsディレクトリから読み込む
+func loadODPTBusTimetables(operator string) ([]ODPTBusTimetable, error) {
+	var odptTimetables []ODPTBusTimetable
+	if err := loadODPTAsset("BusTimetable", operator, &odptTimetables); err != nil {
+		return nil, err
+	}
+	return odptTimetables, nil
+}
+
+// ODPTデータファイル (odpt_<型>_<事業者>.json) を読み込むファイルシステム
+// 既定はバイナリに埋め込んだassetsディレクトリ。ローカルサーバーではUseAssetsDirでディスク上のディレクトリに切り替えられる
+var assetFS fs.FS = assets.FS
+
+// 時刻表 (timetablesディレクトリ) を読み込むファイルシステム
+// 時刻表はバイナリに埋め込まないため、埋め込んだデータを使う場合もカレントディレクトリのassetsから読む
+// Vercelではvercel.jsonのincludeFilesで、時刻表を使う関数にだけファイルを含める
+var timetableFS fs.FS = os.DirFS("assets")
+
+// ODPTデータファイルをディスク上のディレクトリから読み込むようにする
+func UseAssetsDir(dir string) {
+	assetFS = os.DirFS(dir)
+	timetableFS = assetFS
+}
+
+// データ型のファイルを読み込むファイルシステム
+func assetFSFor(dataType string) fs.FS {
+	if isTimetableDataset(dataType) {
+		return timetableFS
+	}
+	return assetFS
+}
+
+// 事業者のassetsのODPTデータファイルを読み込んでvにパースする
+// ファイル名は事業者の登録情報のassetNameから決まる (例: odpt_BusstopPole_Toei.json、時刻表はtimetables/odpt_BusTimetable_Toei.json)
+func loadODPTAsset(dataType, operatorID string, v interface{}) error {
+	operator := lookupOperator(operatorID)
+	if operator == nil {
+		return fmt.Errorf("unknown operator %s: %w", operatorID, fs.ErrNotExist)
+	}
+	return readODPTAsset(assetFSFor(dataType), assetPath(dataType, operator), v)
+}
+
+// ODPTデータファイルを読み込んでvにパースする
+func readODPTAsset(fsys fs.FS, fileName string, v interface{}) error {
+	log.Printf("Loading data from: %s", fileName)
+
+	file, err := fs.ReadFile(fsys, fileName)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(file, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", fileName, err)
+	}
+
+	return nil
+}
+
+// ODPTのtitle(文字列または多言語マップ)から日本語のバス停名を取り出す
+func busstopTitle(odptBusstop ODPTBusstopPole) string {
+	if odptBusstop.DCTitle != "" {
+		return odptBusstop.DCTitle
+	}
+	if titleString, ok := odptBusstop.Title.(string); ok {
+		return titleString
+	}
+	return odptTitleIn(odptBusstop.Title, "ja")
+}
+
+// バス停名の読み (odpt:kana、なければtitleのja-Hrkt)
+func busstopKana(odptBusstop ODPTBusstopPole) string {
+	if odptBusstop.Kana != "" {
+		return odptBusstop.Kana
+	}
+	return odptTitleIn(odptBusstop.Title, "ja-Hrkt")
+}
+
+// ODPTのtitleの多言語マップから指定した言語の名称を取り出す。ない場合は空文字列
+func odptTitleIn(title interface{}, lang string) string {
+	if titleMap, ok := title.(map[string]interface{}); ok {
+		if value, ok := titleMap[lang].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
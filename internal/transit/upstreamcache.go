@@ -0,0 +1,263 @@
+package transit
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ODPT_CACHE_TTL が未設定の場合のキャッシュの有効期間
+const defaultODPTCacheTTL = 10 * time.Second
+
+// ODPT APIの障害時に古いデータを返す上限。これより古いデータは捨てる
+const maxStaleAge = 30 * time.Minute
+
+// 共有する上流リクエストの時間の上限。最初に要求したクライアントが切断しても、待っている他のクライアントのために続ける
+const odptFetchTimeout = 10 * time.Second
+
+// odptBusSnapshot ある時点でODPT APIから取得した車両情報
+type odptBusSnapshot struct {
+	buses     []ODPTBus
+	fetchedAt time.Time
+	stale     bool // ODPT APIの障害のため、最後に取得できたデータを返している
+}
+
+// odptBusCacheEntry 1つの上流クエリの取得結果。取得中はreadyが閉じられていない
+type odptBusCacheEntry struct {
+	ready    chan struct{}
+	snapshot *odptBusSnapshot
+	err      *upstreamError
+	expires  time.Time
+}
+
+// odptBusCache 正規化した上流クエリごとにodpt:Busの取得結果を共有するキャッシュ
+// 同じクエリへの同時のリクエストは1回の上流リクエストにまとめる
+// ODPT APIの一時的な障害時は事業者ごとのサーキットブレーカーで上流へのリクエストを控え、最後に取得できたデータを返す
+type odptBusCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	entries  map[string]*odptBusCacheEntry
+	lastGood map[string]*odptBusSnapshot // キャッシュのキー → そのクエリで最後に取得できたデータ
+	breakers map[string]*circuitBreaker  // 事業者 → サーキットブレーカー
+	fetch    func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError)
+}
+
+var sharedBusCache = &odptBusCache{
+	ttl:      odptCacheTTL(),
+	entries:  make(map[string]*odptBusCacheEntry),
+	lastGood: make(map[string]*odptBusSnapshot),
+	breakers: make(map[string]*circuitBreaker),
+	fetch:    fetchODPTBuses,
+}
+
+// 環境変数 ODPT_CACHE_TTL (例: 10s) からキャッシュの有効期間を取得する。0でキャッシュしない
+func odptCacheTTL() time.Duration {
+	value := os.Getenv("ODPT_CACHE_TTL")
+	if value == "" {
+		return defaultODPTCacheTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		log.Printf("Invalid ODPT_CACHE_TTL %q, using %v", value, defaultODPTCacheTTL)
+		return defaultODPTCacheTTL
+	}
+	return ttl
+}
+
+// 事業者とフィルタからキャッシュのキーを作る。url.Valuesのキーはソートされるため、パラメータの順序によらず同じキーになる
+func odptBusCacheKey(operator string, filters url.Values) string {
+	q := url.Values{}
+	q.Set("odpt:operator", operator)
+	for key, values := range filters {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
+	return q.Encode()
+}
+
+// 車両情報をキャッシュから取得する。有効なキャッシュがなければODPT APIから取得する
+// ODPT APIが一時的に使えない場合は、最後に取得できたデータをstaleとして返す
+func (c *odptBusCache) get(ctx context.Context, operator string, filters url.Values) (*odptBusSnapshot, *upstreamError) {
+	key := odptBusCacheKey(operator, filters)
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		select {
+		case <-entry.ready:
+			if now.Before(entry.expires) {
+				c.mu.Unlock()
+				odptCacheRequests.add(1, "hit")
+				return entry.snapshot, nil
+			}
+		default:
+			// 同じクエリを取得中のリクエストの結果を待つ。待っている間にクライアントが切断した場合は待つのをやめる
+			c.mu.Unlock()
+			odptCacheRequests.add(1, "coalesced")
+			select {
+			case <-entry.ready:
+				return entry.snapshot, entry.err
+			case <-ctx.Done():
+				return nil, &upstreamError{http.StatusGatewayTimeout, "Request canceled while waiting for external API", false}
+			}
+		}
+	}
+
+	c.removeExpired(now)
+
+	breaker := c.breaker(operator)
+	if !breaker.allow(now) {
+		snapshot, err := c.staleSnapshot(operator, filters, &upstreamError{http.StatusServiceUnavailable, "External API is temporarily unavailable", true})
+		c.mu.Unlock()
+		odptCacheRequests.add(1, "breaker_open")
+		return snapshot, err
+	}
+
+	entry := &odptBusCacheEntry{ready: make(chan struct{})}
+	c.entries[key] = entry
+	c.mu.Unlock()
+	odptCacheRequests.add(1, "miss")
+
+	// リクエストのキャンセルは引き継がない (ログ用のリクエストIDなどの値は引き継ぐ)
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), odptFetchTimeout)
+	buses, err := c.fetch(fetchCtx, operator, filters)
+	cancel()
+	fetchedAt := time.Now()
+
+	c.mu.Lock()
+	switch {
+	case err == nil:
+		breaker.success()
+		entry.snapshot = &odptBusSnapshot{buses: buses, fetchedAt: fetchedAt}
+		entry.expires = odptBusExpiry(buses, fetchedAt, c.ttl)
+		c.lastGood[key] = entry.snapshot
+		observeVehicleSnapshot(operator, buses)
+	case err.temporary:
+		breaker.failure(fetchedAt)
+		entry.snapshot, entry.err = c.staleSnapshot(operator, filters, err)
+	default:
+		entry.err = err
+	}
+	// エラーと古いデータはキャッシュしない
+	if entry.snapshot == nil || entry.snapshot.stale {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(entry.ready)
+
+	return entry.snapshot, entry.err
+}
+
+// 事業者のサーキットブレーカーを返す。c.muを保持した状態で呼び出す
+func (c *odptBusCache) breaker(operator string) *circuitBreaker {
+	breaker, ok := c.breakers[operator]
+	if !ok {
+		breaker = &circuitBreaker{}
+		c.breakers[operator] = breaker
+	}
+	return breaker
+}
+
+// 最後に取得できたデータがあればstaleとして返し、なければerrを返す。c.muを保持した状態で呼び出す
+// 同じクエリで取得したデータと、事業者のフィルタなしのデータにフィルタを適用したもののうち、新しい方を返す
+func (c *odptBusCache) staleSnapshot(operator string, filters url.Values, err *upstreamError) (*odptBusSnapshot, *upstreamError) {
+	var buses []ODPTBus
+	var fetchedAt time.Time
+	if lastGood, ok := c.lastGood[odptBusCacheKey(operator, filters)]; ok {
+		buses, fetchedAt = lastGood.buses, lastGood.fetchedAt
+	}
+	if unfiltered, ok := c.lastGood[odptBusCacheKey(operator, nil)]; ok && unfiltered.fetchedAt.After(fetchedAt) {
+		buses, fetchedAt = filterODPTBuses(unfiltered.buses, filters), unfiltered.fetchedAt
+	}
+	if fetchedAt.IsZero() {
+		return nil, err
+	}
+	log.Printf("Serving stale vehicle data from %s: %s", fetchedAt.Format(time.RFC3339), err.message)
+	return &odptBusSnapshot{buses: buses, fetchedAt: fetchedAt, stale: true}, nil
+}
+
+// ODPT APIのクエリパラメータ (odpt:busroutePatternなど) と同じ条件で車両情報を絞り込む
+func filterODPTBuses(odptBuses []ODPTBus, filters url.Values) []ODPTBus {
+	if len(filters) == 0 {
+		return odptBuses
+	}
+	filter := newBusFilter()
+	for key, values := range filters {
+		for _, value := range values {
+			filter.add(strings.TrimPrefix(key, "odpt:"), value)
+		}
+	}
+	result := make([]ODPTBus, 0, len(odptBuses))
+	for _, odptBus := range odptBuses {
+		if filter.matches(convertODPTBuses([]ODPTBus{odptBus})[0]) {
+			result = append(result, odptBus)
+		}
+	}
+	return result
+}
+
+// 期限切れのエントリと古すぎるデータを削除する。c.muを保持した状態で呼び出す
+func (c *odptBusCache) removeExpired(now time.Time) {
+	for key, entry := range c.entries {
+		select {
+		case <-entry.ready:
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+	for key, snapshot := range c.lastGood {
+		if now.Sub(snapshot.fetchedAt) > maxStaleAge {
+			delete(c.lastGood, key)
+		}
+	}
+}
+
+// キャッシュの有効期限を求める。TTLを上限とし、取得時点でまだ有効な車両のdct:validのうち最も早いものまでとする
+func odptBusExpiry(buses []ODPTBus, fetchedAt time.Time, ttl time.Duration) time.Time {
+	expires := fetchedAt.Add(ttl)
+	for _, bus := range buses {
+		if bus.Valid == "" {
+			continue
+		}
+		valid, err := time.Parse(time.RFC3339, bus.Valid)
+		if err != nil || !valid.After(fetchedAt) {
+			continue
+		}
+		if valid.Before(expires) {
+			expires = valid
+		}
+	}
+	return expires
+}
+
+// 返した車両情報の鮮度をレスポンスヘッダーに設定する
+// Ageは最も古いデータの取得からの経過秒数。障害のため古いデータを返した場合はWarningとX-Staleを付ける
+func setSnapshotHeaders(w http.ResponseWriter, snapshots []*odptBusSnapshot) {
+	var oldest time.Time
+	stale := false
+	for _, snapshot := range snapshots {
+		if oldest.IsZero() || snapshot.fetchedAt.Before(oldest) {
+			oldest = snapshot.fetchedAt
+		}
+		stale = stale || snapshot.stale
+	}
+	if oldest.IsZero() {
+		return
+	}
+
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(oldest).Seconds())))
+	w.Header().Set("X-Data-Timestamp", oldest.Format(time.RFC3339))
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		w.Header().Set("X-Stale", "true")
+	}
+}
@@ -0,0 +1,366 @@
+package transit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOperator = "odpt.Operator:Toei"
+
+func newTestBusCache(fetch func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError)) *odptBusCache {
+	return &odptBusCache{
+		ttl:      time.Minute,
+		entries:  make(map[string]*odptBusCacheEntry),
+		lastGood: make(map[string]*odptBusSnapshot),
+		breakers: make(map[string]*circuitBreaker),
+		fetch:    fetch,
+	}
+}
+
+var testODPTBuses = []ODPTBus{
+	{SameAs: "bus1", BusNumber: "B786", BusroutePattern: "odpt.BusroutePattern:Toei.RH01.8403.1"},
+	{SameAs: "bus2", BusNumber: "B791", BusroutePattern: "odpt.BusroutePattern:Toei.RH01.8403.1"},
+	{SameAs: "bus3", BusNumber: "A512", BusroutePattern: "odpt.BusroutePattern:Toei.To01.1.1"},
+}
+
+func TestODPTBusCacheKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    url.Values
+		sameKey bool
+	}{
+		{
+			name:    "parameter order",
+			a:       url.Values{"odpt:busNumber": {"B786"}, "odpt:busroutePattern": {"p1"}},
+			b:       url.Values{"odpt:busroutePattern": {"p1"}, "odpt:busNumber": {"B786"}},
+			sameKey: true,
+		},
+		{
+			name:    "nil and empty filters",
+			a:       nil,
+			b:       url.Values{},
+			sameKey: true,
+		},
+		{
+			name: "different values",
+			a:    url.Values{"odpt:busNumber": {"B786"}},
+			b:    url.Values{"odpt:busNumber": {"B791"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := odptBusCacheKey(testOperator, tt.a), odptBusCacheKey(testOperator, tt.b)
+			assert.Equal(t, tt.sameKey, a == b)
+		})
+	}
+}
+
+func TestODPTBusCacheCoalescesConcurrentRequests(t *testing.T) {
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache := newTestBusCache(func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return testODPTBuses, nil
+	})
+
+	const clients = 10
+	results := make([]*odptBusSnapshot, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			snapshot, err := cache.get(context.Background(), testOperator, nil)
+			assert.Nil(t, err)
+			results[i] = snapshot
+		}(i)
+	}
+	<-started
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for _, snapshot := range results {
+		require.NotNil(t, snapshot)
+		assert.Same(t, results[0], snapshot)
+	}
+
+	// 有効期間内は上流へ問い合わせない
+	_, err := cache.get(context.Background(), testOperator, url.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestODPTBusCacheWaiterCancellation(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetchErr := make(chan error, 1)
+	cache := newTestBusCache(func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+		close(started)
+		<-release
+		fetchErr <- ctx.Err()
+		return testODPTBuses, nil
+	})
+
+	// 最初のクライアントが切断しても共有の取得は続ける
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	first := make(chan *odptBusSnapshot)
+	go func() {
+		snapshot, _ := cache.get(firstCtx, testOperator, nil)
+		first <- snapshot
+	}()
+	<-started
+	cancelFirst()
+
+	// 待っているクライアントは切断すると結果を待たずに戻る
+	waiterCtx, cancelWaiter := context.WithCancel(context.Background())
+	cancelWaiter()
+	snapshot, err := cache.get(waiterCtx, testOperator, nil)
+	assert.Nil(t, snapshot)
+	require.NotNil(t, err)
+	assert.False(t, err.temporary)
+
+	close(release)
+	assert.NoError(t, <-fetchErr)
+	assert.NotNil(t, <-first)
+}
+
+func TestODPTBusCacheServesStaleSnapshotPerOperator(t *testing.T) {
+	upstreamDown := false
+	cache := newTestBusCache(func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+		if upstreamDown {
+			return nil, &upstreamError{http.StatusBadGateway, "External API returned status: 503", true}
+		}
+		return filterODPTBuses(testODPTBuses, filters), nil
+	})
+
+	// フィルタなしで一度取得しておく
+	_, err := cache.get(context.Background(), testOperator, nil)
+	require.Nil(t, err)
+	upstreamDown = true
+
+	tests := []struct {
+		name    string
+		filters url.Values
+		want    []string
+	}{
+		{name: "unfiltered", want: []string{"bus1", "bus2", "bus3"}},
+		{
+			name:    "filter never fetched before",
+			filters: url.Values{"odpt:busroutePattern": {"odpt.BusroutePattern:Toei.RH01.8403.1"}},
+			want:    []string{"bus1", "bus2"},
+		},
+		{
+			name:    "multiple filters",
+			filters: url.Values{"odpt:busroutePattern": {"odpt.BusroutePattern:Toei.RH01.8403.1"}, "odpt:busNumber": {"B791"}},
+			want:    []string{"bus2"},
+		},
+		{
+			name:    "no match",
+			filters: url.Values{"odpt:busNumber": {"Z999"}},
+			want:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.entries = make(map[string]*odptBusCacheEntry)
+			snapshot, err := cache.get(context.Background(), testOperator, tt.filters)
+			require.Nil(t, err)
+			assert.True(t, snapshot.stale)
+			ids := []string{}
+			for _, bus := range snapshot.buses {
+				ids = append(ids, bus.SameAs)
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+}
+
+func TestODPTBusCacheServesStaleSnapshotForFilteredClients(t *testing.T) {
+	upstreamDown := false
+	cache := newTestBusCache(func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+		if upstreamDown {
+			return nil, &upstreamError{http.StatusBadGateway, "External API returned status: 503", true}
+		}
+		return filterODPTBuses(testODPTBuses, filters), nil
+	})
+
+	// フィルタ付きのリクエストだけでも、同じクエリの最後のデータを返せる
+	filters := url.Values{"odpt:busroutePattern": {"odpt.BusroutePattern:Toei.To01.1.1"}}
+	_, err := cache.get(context.Background(), testOperator, filters)
+	require.Nil(t, err)
+	upstreamDown = true
+	cache.entries = make(map[string]*odptBusCacheEntry)
+
+	snapshot, err := cache.get(context.Background(), testOperator, filters)
+	require.Nil(t, err)
+	assert.True(t, snapshot.stale)
+	require.Len(t, snapshot.buses, 1)
+	assert.Equal(t, "bus3", snapshot.buses[0].SameAs)
+
+	// 取得したことのない別のフィルタには返せるデータがない
+	snapshot, err = cache.get(context.Background(), testOperator, url.Values{"odpt:busNumber": {"B786"}})
+	assert.Nil(t, snapshot)
+	require.NotNil(t, err)
+}
+
+func TestODPTBusCacheBreakerPerOperator(t *testing.T) {
+	const otherOperator = "odpt.Operator:KeioBus"
+	var otherCalls atomic.Int32
+	cache := newTestBusCache(func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+		if operator == testOperator {
+			return nil, &upstreamError{http.StatusBadGateway, "External API returned status: 503", true}
+		}
+		otherCalls.Add(1)
+		return testODPTBuses, nil
+	})
+
+	for i := 0; i < breakerThreshold; i++ {
+		_, err := cache.get(context.Background(), testOperator, nil)
+		require.NotNil(t, err)
+	}
+	_, err := cache.get(context.Background(), testOperator, nil)
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, err.status, "breaker is open for the failing operator")
+
+	// 他の事業者へのリクエストは止めない
+	cache.entries = make(map[string]*odptBusCacheEntry)
+	_, err = cache.get(context.Background(), otherOperator, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), otherCalls.Load())
+}
+
+func TestODPTBusCacheWithoutStaleSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *upstreamError
+	}{
+		{name: "temporary failure", err: &upstreamError{http.StatusGatewayTimeout, "External API timed out", true}},
+		{name: "permanent failure", err: &upstreamError{http.StatusBadGateway, "External API returned status: 403", false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestBusCache(func(ctx context.Context, operator string, filters url.Values) ([]ODPTBus, *upstreamError) {
+				return nil, tt.err
+			})
+			snapshot, err := cache.get(context.Background(), testOperator, nil)
+			assert.Nil(t, snapshot)
+			assert.Equal(t, tt.err, err)
+			assert.Empty(t, cache.entries, "errors must not be cached")
+		})
+	}
+}
+
+func TestCircuitBreakerBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 3, want: 5 * time.Second},
+		{failures: 4, want: 10 * time.Second},
+		{failures: 5, want: 20 * time.Second},
+		{failures: 8, want: 160 * time.Second},
+		{failures: 9, want: 5 * time.Minute},
+		{failures: 100, want: 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		b := circuitBreaker{failures: tt.failures}
+		assert.Equal(t, tt.want, b.backoff(), "failures=%d", tt.failures)
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Date(2025, 12, 1, 12, 0, 0, 0, time.UTC)
+	var b circuitBreaker
+
+	for i := 0; i < breakerThreshold; i++ {
+		require.True(t, b.allow(now))
+		b.failure(now)
+	}
+	assert.False(t, b.allow(now.Add(4*time.Second)), "open during the first backoff")
+
+	// 止める時間が過ぎると1回だけ試す
+	trial := now.Add(5 * time.Second)
+	assert.True(t, b.allow(trial))
+	assert.False(t, b.allow(trial.Add(time.Second)), "only one trial request")
+
+	// 試しも失敗すると止める時間が倍になる
+	b.failure(trial)
+	assert.False(t, b.allow(trial.Add(9*time.Second)))
+	assert.True(t, b.allow(trial.Add(10*time.Second)))
+
+	b.success()
+	assert.True(t, b.allow(trial.Add(10*time.Second)))
+	assert.Equal(t, 0, b.failures)
+}
+
+func TestFetchODPTBusesCanceled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	baseURL := odptAPIBaseURL
+	odptAPIBaseURL = server.URL
+	defer func() { odptAPIBaseURL = baseURL }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	buses, err := fetchODPTBuses(ctx, testOperator, nil)
+	assert.Nil(t, buses)
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, err.status)
+	assert.Less(t, time.Since(start), odptHTTPClient.Timeout)
+}
+
+func TestFetchODPTBusesMapsUpstreamStatus(t *testing.T) {
+	tests := []struct {
+		status    int
+		temporary bool
+	}{
+		{status: http.StatusUnauthorized},
+		{status: http.StatusForbidden},
+		{status: http.StatusNotFound},
+		{status: http.StatusTooManyRequests, temporary: true},
+		{status: http.StatusServiceUnavailable, temporary: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			baseURL := odptAPIBaseURL
+			odptAPIBaseURL = server.URL
+			defer func() { odptAPIBaseURL = baseURL }()
+
+			buses, err := fetchODPTBuses(context.Background(), testOperator, nil)
+			assert.Nil(t, buses)
+			require.NotNil(t, err)
+			assert.Equal(t, http.StatusBadGateway, err.status)
+			assert.Equal(t, tt.temporary, err.temporary)
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package transit
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 購読中の事業者の車両情報をODPT APIから取得する間隔
+const vehiclePollInterval = 15 * time.Second
+
+// 購読者ごとのイベントのバッファ数。溢れた購読者は切断する
+const vehicleSubscriberBuffer = 256
+
+// 車両イベントの種類
+const (
+	vehicleEventUpdate = "update" // 車両の追加または変化
+	vehicleEventRemove = "remove" // 車両がフィードから消えた
+)
+
+// vehicleEvent 共有ポーラーから購読者へ配信する車両の変化
+type vehicleEvent struct {
+	kind string
+	bus  Bus
+}
+
+// vehicleSubscriber 車両イベントの購読者
+type vehicleSubscriber struct {
+	events chan vehicleEvent
+	closed bool
+}
+
+// バッファに空きがあればイベントを送る。空きがなければfalseを返す
+func (s *vehicleSubscriber) send(event vehicleEvent) bool {
+	select {
+	case s.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// operatorFeed 事業者ごとのポーリング状態
+type operatorFeed struct {
+	operator    string
+	subscribers map[*vehicleSubscriber]struct{}
+	vehicles    map[string]Bus
+	states      map[string]busState // 変化の検出に使う直前の車両情報
+	stop        chan struct{}
+}
+
+// busState 変化の検出に使うODPTの車両情報のフィールド
+// 推定位置は取得のたびに経過時間で変わるため比べず、ODPTのレコードが変わった車両だけを配信する
+type busState struct {
+	date                int64 // dc:date (UnixNano)
+	fromBusstopPoleTime int64 // odpt:fromBusstopPoleTime (UnixNano)。ない場合は0
+	note                string
+	busNumber           string
+	busTimetable        string
+	busroutePattern     string
+	fromBusstopPole     string
+	toBusstopPole       string
+	startingBusstopPole string
+	terminalBusstopPole string
+}
+
+func newBusState(bus Bus) busState {
+	state := busState{
+		date:                bus.Date.UnixNano(),
+		note:                bus.Note,
+		busNumber:           bus.BusNumber,
+		busTimetable:        bus.BusTimetable,
+		busroutePattern:     bus.BusroutePattern,
+		fromBusstopPole:     bus.FromBusstopPole,
+		toBusstopPole:       bus.ToBusstopPole,
+		startingBusstopPole: bus.StartingBusstopPole,
+		terminalBusstopPole: bus.TerminalBusstopPole,
+	}
+	if bus.FromBusstopPoleTime != nil {
+		state.fromBusstopPoleTime = bus.FromBusstopPoleTime.UnixNano()
+	}
+	return state
+}
+
+// vehicleHub 購読者がいる事業者だけを共有のポーラーで取得し、変化を購読者に配信する
+type vehicleHub struct {
+	mu    sync.Mutex
+	feeds map[string]*operatorFeed
+}
+
+var sharedVehicleHub = &vehicleHub{feeds: make(map[string]*operatorFeed)}
+
+// 事業者の車両イベントを購読し、現在の車両一覧を返す
+func (h *vehicleHub) subscribe(operators []string) (*vehicleSubscriber, []Bus) {
+	sub := &vehicleSubscriber{events: make(chan vehicleEvent, vehicleSubscriberBuffer)}
+	return sub, h.setOperators(sub, operators)
+}
+
+// 購読する事業者を入れ替え、購読中の事業者の現在の車両一覧を返す
+// 新たに購読者ができた事業者はポーリングを開始し、購読者がいなくなった事業者は停止する
+func (h *vehicleHub) setOperators(sub *vehicleSubscriber, operators []string) []Bus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sub.closed {
+		return nil
+	}
+
+	wanted := make(map[string]bool, len(operators))
+	for _, operator := range operators {
+		wanted[operator] = true
+	}
+	for operator := range h.feeds {
+		if !wanted[operator] {
+			h.removeSubscriber(operator, sub)
+		}
+	}
+
+	var snapshot []Bus
+	for operator := range wanted {
+		feed, ok := h.feeds[operator]
+		if !ok {
+			feed = &operatorFeed{
+				operator:    operator,
+				subscribers: make(map[*vehicleSubscriber]struct{}),
+				vehicles:    make(map[string]Bus),
+				states:      make(map[string]busState),
+				stop:        make(chan struct{}),
+			}
+			h.feeds[operator] = feed
+			go h.poll(feed)
+		}
+		feed.subscribers[sub] = struct{}{}
+		for _, bus := range feed.vehicles {
+			snapshot = append(snapshot, bus)
+		}
+	}
+
+	return snapshot
+}
+
+// 購読を解除する。購読者がいなくなった事業者のポーリングは停止する
+func (h *vehicleHub) unsubscribe(sub *vehicleSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.drop(sub)
+}
+
+// 購読者をすべての事業者から外してイベントのチャネルを閉じる。h.muを保持した状態で呼び出す
+func (h *vehicleHub) drop(sub *vehicleSubscriber) {
+	for operator := range h.feeds {
+		h.removeSubscriber(operator, sub)
+	}
+	if !sub.closed {
+		sub.closed = true
+		close(sub.events)
+	}
+}
+
+// h.muを保持した状態で呼び出す
+func (h *vehicleHub) removeSubscriber(operator string, sub *vehicleSubscriber) {
+	feed, ok := h.feeds[operator]
+	if !ok {
+		return
+	}
+	if _, ok := feed.subscribers[sub]; !ok {
+		return
+	}
+	delete(feed.subscribers, sub)
+	if len(feed.subscribers) == 0 {
+		close(feed.stop)
+		delete(h.feeds, operator)
+		log.Printf("Stopped polling vehicles for operator: %s", operator)
+	}
+}
+
+// 事業者の車両情報を定期的に取得し、変化を配信する
+func (h *vehicleHub) poll(feed *operatorFeed) {
+	log.Printf("Started polling vehicles for operator: %s", feed.operator)
+
+	ticker := time.NewTicker(vehiclePollInterval)
+	defer ticker.Stop()
+
+	for {
+		h.refresh(feed)
+
+		select {
+		case <-feed.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *vehicleHub) refresh(feed *operatorFeed) {
+	snapshot, upstreamErr := sharedBusCache.get(context.Background(), feed.operator, nil)
+	if upstreamErr != nil {
+		// 取得に失敗した場合は直前の状態を保ったまま次の取得を待つ
+		log.Printf("Error polling vehicles for operator %s: %s", feed.operator, upstreamErr.message)
+		return
+	}
+
+	// 購読者ごとにexpandの指定が異なるため、すべてのバス停を展開しておく
+	buses := convertODPTBuses(snapshot.buses)
+	expand, _ := parseExpand("busstopPole")
+	static := getStaticData()
+	enrichBuses(buses, static.busstopPoleSummaries(feed.operator), static.routePatterns(feed.operator), expand, time.Now())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	select {
+	case <-feed.stop:
+		return
+	default:
+	}
+
+	var events []vehicleEvent
+	seen := make(map[string]bool, len(buses))
+	for _, bus := range buses {
+		seen[bus.ID] = true
+		state := newBusState(bus)
+		if previous, ok := feed.states[bus.ID]; ok && previous == state {
+			continue
+		}
+		feed.vehicles[bus.ID] = bus
+		feed.states[bus.ID] = state
+		events = append(events, vehicleEvent{kind: vehicleEventUpdate, bus: bus})
+	}
+	for id, bus := range feed.vehicles {
+		if seen[id] {
+			continue
+		}
+		delete(feed.vehicles, id)
+		delete(feed.states, id)
+		events = append(events, vehicleEvent{kind: vehicleEventRemove, bus: bus})
+	}
+
+	for sub := range feed.subscribers {
+		for _, event := range events {
+			if !sub.send(event) {
+				// 受信が追いつかない購読者は配信を止めないよう切断する
+				log.Printf("Dropping slow vehicle subscriber for operator: %s", feed.operator)
+				h.drop(sub)
+				break
+			}
+		}
+	}
+
+	if len(events) > 0 {
+		log.Printf("Broadcast %d vehicle events for operator: %s", len(events), feed.operator)
+	}
+}
+
+// busFilter 車両情報をクエリパラメータの条件で絞り込むフィルタ
+// 異なるパラメータの条件はすべて満たす必要があり、同じパラメータに複数の値がある場合はいずれかに一致すればよい
+type busFilter struct {
+	values map[string]map[string]bool // busFilterParamsのパラメータ名と値
+	bbox   *boundingBox
+}
+
+func newBusFilter() *busFilter {
+	return &busFilter{values: make(map[string]map[string]bool)}
+}
+
+// busFilterParamsとbboxパラメータからフィルタを作成する
+func parseBusFilter(q url.Values) (*busFilter, error) {
+	filter := newBusFilter()
+	for _, param := range busFilterParams {
+		if value := q.Get(param); value != "" {
+			filter.add(param, value)
+		}
+	}
+
+	bbox, err := parseBoundingBox(q.Get("bbox"))
+	if err != nil {
+		return nil, err
+	}
+	filter.bbox = bbox
+
+	return filter, nil
+}
+
+func (f *busFilter) add(param, value string) {
+	if f.values[param] == nil {
+		f.values[param] = make(map[string]bool)
+	}
+	f.values[param][value] = true
+}
+
+func (f *busFilter) remove(param, value string) {
+	delete(f.values[param], value)
+	if len(f.values[param]) == 0 {
+		delete(f.values, param)
+	}
+}
+
+// 車両がフィルタの条件をすべて満たすか判定する
+func (f *busFilter) matches(bus Bus) bool {
+	for param, values := range f.values {
+		if !values[busFieldValue(bus, param)] {
+			return false
+		}
+	}
+	if f.bbox != nil && len(filterBusesInBoundingBox([]Bus{bus}, f.bbox)) == 0 {
+		return false
+	}
+	return true
+}
+
+// busFilterParamsのパラメータ名に対応する車両のフィールドの値を返す
+func busFieldValue(bus Bus, param string) string {
+	switch param {
+	case "busNumber":
+		return bus.BusNumber
+	case "busTimetable":
+		return bus.BusTimetable
+	case "toBusstopPole":
+		return bus.ToBusstopPole
+	case "busroutePattern":
+		return bus.BusroutePattern
+	case "fromBusstopPole":
+		return bus.FromBusstopPole
+	case "startingBusstopPole":
+		return bus.StartingBusstopPole
+	case "terminalBusstopPole":
+		return bus.TerminalBusstopPole
+	}
+	return ""
+}
+
+// expandで指定されていないバス停の展開結果を取り除く
+func trimExpanded(bus Bus, expand map[string]bool) Bus {
+	if !expand["fromBusstopPole"] {
+		bus.FromBusstopPoleDetail = nil
+	}
+	if !expand["toBusstopPole"] {
+		bus.ToBusstopPoleDetail = nil
+	}
+	if !expand["startingBusstopPole"] {
+		bus.StartingBusstopPoleDetail = nil
+	}
+	if !expand["terminalBusstopPole"] {
+		bus.TerminalBusstopPoleDetail = nil
+	}
+	return bus
+}
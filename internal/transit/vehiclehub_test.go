@@ -0,0 +1,68 @@
+package transit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBusStateIgnoresEstimatedPosition(t *testing.T) {
+	date := time.Date(2025, 12, 1, 17, 56, 31, 0, japanTime)
+	departed := date.Add(-time.Minute)
+	base := Bus{
+		ID:                  "bus1",
+		Date:                date,
+		BusNumber:           "B786",
+		BusroutePattern:     "odpt.BusroutePattern:Toei.RH01.8403.1",
+		FromBusstopPole:     "odpt.BusstopPole:Toei.ShibuyaStation.636.6",
+		FromBusstopPoleTime: &departed,
+		ToBusstopPole:       "odpt.BusstopPole:Toei.AoyamagakuinChutobu.7.1",
+	}
+	bearing := 72.4
+
+	tests := []struct {
+		name    string
+		modify  func(bus *Bus)
+		changed bool
+	}{
+		{
+			name: "estimated position moved",
+			modify: func(bus *Bus) {
+				bus.EstimatedPosition = &VehiclePosition{Lat: 35.66, Long: 139.70, Bearing: &bearing}
+			},
+		},
+		{
+			name: "same departure time in another pointer",
+			modify: func(bus *Bus) {
+				departedCopy := departed.UTC()
+				bus.FromBusstopPoleTime = &departedCopy
+			},
+		},
+		{
+			name:    "record updated",
+			modify:  func(bus *Bus) { bus.Date = date.Add(15 * time.Second) },
+			changed: true,
+		},
+		{
+			name: "next stop changed",
+			modify: func(bus *Bus) {
+				bus.FromBusstopPole, bus.ToBusstopPole = bus.ToBusstopPole, "odpt.BusstopPole:Toei.Nishiazabu.1736.2"
+			},
+			changed: true,
+		},
+		{
+			name:    "departure time cleared",
+			modify:  func(bus *Bus) { bus.FromBusstopPoleTime = nil },
+			changed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := base
+			tt.modify(&bus)
+			assert.Equal(t, tt.changed, newBusState(base) != newBusState(bus))
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package transit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketの接続維持と送信のタイムアウト
+const (
+	wsPingInterval = 30 * time.Second // pingを送る間隔
+	wsPongWait     = 60 * time.Second // pongが返ってこない接続を切断するまでの時間
+	wsWriteWait    = 10 * time.Second // 1メッセージの送信を待つ時間。超えた接続は切断する
+	wsMaxMessage   = 64 * 1024        // クライアントから受け付けるメッセージの最大サイズ
+)
+
+// クライアントからのメッセージのaction
+const (
+	wsActionSubscribe   = "subscribe"
+	wsActionUnsubscribe = "unsubscribe"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// CORSMiddlewareと同様に任意のオリジンからの接続を受け付ける
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest クライアントから送られる購読の追加・解除
+// フィルタはbusFilterParamsと同じ名前で、値の配列を指定する
+type wsRequest struct {
+	Action   string              `json:"action"`
+	Operator []string            `json:"operator,omitempty"`
+	Filters  map[string][]string `json:"filters,omitempty"`
+	BBox     string              `json:"bbox,omitempty"`
+	Expand   *string             `json:"expand,omitempty"`
+
+	err error // メッセージがJSONとして読み取れなかった場合のエラー
+}
+
+// wsSubscription 現在の購読内容。購読の変更ごとにクライアントへ返す
+type wsSubscription struct {
+	Operator []string            `json:"operator"`
+	Filters  map[string][]string `json:"filters"`
+	BBox     string              `json:"bbox,omitempty"`
+	Expand   []string            `json:"expand,omitempty"`
+}
+
+// wsMessage サーバーから送るメッセージ
+type wsMessage struct {
+	Type         string          `json:"type"` // subscribed, update, remove, error
+	Bus          *Bus            `json:"bus,omitempty"`
+	ID           string          `json:"id,omitempty"`
+	Operator     string          `json:"operator,omitempty"`
+	Subscription *wsSubscription `json:"subscription,omitempty"`
+	Message      string          `json:"message,omitempty"`
+}
+
+// wsClient 1つのWebSocket接続の購読状態
+type wsClient struct {
+	conn      *websocket.Conn
+	sub       *vehicleSubscriber
+	operators map[string]bool
+	filter    *busFilter
+	bbox      string
+	expand    map[string]bool
+	lang      *languagePreference
+	sent      map[string]Bus // クライアントに送信済みで条件に合っている車両
+}
+
+// WebSocketで購読条件を受け付け、車両の変化を配信するハンドラー
+func GetBusVehicleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// 名称の言語は接続時のlangパラメータまたはAccept-Languageで決める
+	lang, err := parseLanguage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgradeがクライアントにエラーを返している
+		log.Printf("Error upgrading to WebSocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client := &wsClient{
+		conn:      conn,
+		operators: make(map[string]bool),
+		filter:    newBusFilter(),
+		expand:    make(map[string]bool),
+		lang:      lang,
+		sent:      make(map[string]Bus),
+	}
+	client.sub, _ = sharedVehicleHub.subscribe(nil)
+	defer sharedVehicleHub.unsubscribe(client.sub)
+
+	log.Printf("Opened vehicle WebSocket from %s", r.RemoteAddr)
+
+	// 受信は別のgoroutineで行い、送信はこのgoroutineだけで行う
+	requests := make(chan wsRequest)
+	done := make(chan struct{})
+	defer close(done)
+	readErr := make(chan error, 1)
+	go client.readRequests(requests, done, readErr)
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case err = <-readErr:
+			log.Printf("Closed vehicle WebSocket from %s: %v", r.RemoteAddr, err)
+			return
+		case req := <-requests:
+			err = client.apply(req)
+		case event, ok := <-client.sub.events:
+			if !ok {
+				// 受信が追いつかずバッファが溢れたため、配信側から切断された
+				log.Printf("Dropping slow vehicle WebSocket from %s", r.RemoteAddr)
+				client.close(websocket.CloseTryAgainLater, "client too slow")
+				return
+			}
+			err = client.handle(event)
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			log.Printf("Error writing WebSocket to %s: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+// クライアントからのメッセージを読み取る。pongを受け取るたびに読み取り期限を延ばす
+func (c *wsClient) readRequests(requests chan<- wsRequest, done <-chan struct{}, readErr chan<- error) {
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				req = wsRequest{err: errors.New("invalid message")}
+			} else {
+				readErr <- err
+				return
+			}
+		}
+		select {
+		case requests <- req:
+		case <-done:
+			return
+		}
+	}
+}
+
+// 購読の追加・解除を反映し、新たに条件に合った車両と外れた車両を送る
+func (c *wsClient) apply(req wsRequest) error {
+	if err := c.update(req); err != nil {
+		return c.write(wsMessage{Type: "error", Message: err.Error()})
+	}
+
+	operators := make([]string, 0, len(c.operators))
+	for operator := range c.operators {
+		operators = append(operators, operator)
+	}
+	snapshot := sharedVehicleHub.setOperators(c.sub, operators)
+
+	if err := c.write(wsMessage{Type: "subscribed", Subscription: c.subscription()}); err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(snapshot))
+	for _, bus := range snapshot {
+		current[bus.ID] = true
+		if err := c.handle(vehicleEvent{kind: vehicleEventUpdate, bus: bus}); err != nil {
+			return err
+		}
+	}
+	// 購読を外した事業者の車両
+	for id, bus := range c.sent {
+		if !current[id] {
+			if err := c.handle(vehicleEvent{kind: vehicleEventRemove, bus: bus}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 購読内容を更新する。不正な値があった場合は何も変更しない
+func (c *wsClient) update(req wsRequest) error {
+	if req.err != nil {
+		return req.err
+	}
+	if req.Action != wsActionSubscribe && req.Action != wsActionUnsubscribe {
+		return errors.New("invalid action")
+	}
+
+	if len(req.Operator) > 0 {
+		if _, err := parseRealtimeOperators(strings.Join(req.Operator, ",")); err != nil {
+			return err
+		}
+	}
+	for param := range req.Filters {
+		if !isBusFilterParam(param) {
+			return fmt.Errorf("invalid filter: %s", param)
+		}
+	}
+	var bbox *boundingBox
+	if req.Action == wsActionSubscribe {
+		var err error
+		if bbox, err = parseBoundingBox(req.BBox); err != nil {
+			return err
+		}
+	}
+	var expand map[string]bool
+	if req.Expand != nil {
+		var err error
+		if expand, err = parseExpand(*req.Expand); err != nil {
+			return err
+		}
+	}
+
+	for _, operator := range req.Operator {
+		c.operators[operator] = req.Action == wsActionSubscribe
+		if !c.operators[operator] {
+			delete(c.operators, operator)
+		}
+	}
+	for param, values := range req.Filters {
+		for _, value := range values {
+			if req.Action == wsActionSubscribe {
+				c.filter.add(param, value)
+			} else {
+				c.filter.remove(param, value)
+			}
+		}
+	}
+	if req.BBox != "" {
+		if req.Action == wsActionSubscribe {
+			c.filter.bbox, c.bbox = bbox, req.BBox
+		} else {
+			c.filter.bbox, c.bbox = nil, ""
+		}
+	}
+	if expand != nil {
+		c.expand = expand
+	}
+	return nil
+}
+
+// 車両イベントを購読条件に照らして送る
+func (c *wsClient) handle(event vehicleEvent) error {
+	bus := event.bus
+	if event.kind == vehicleEventUpdate && c.filter.matches(bus) {
+		c.sent[bus.ID] = bus
+		bus = trimExpanded(bus, c.expand).localized(c.lang)
+		return c.write(wsMessage{Type: vehicleEventUpdate, Bus: &bus})
+	}
+	// 消えた車両と、条件に合わなくなった車両は削除を通知する
+	if _, ok := c.sent[bus.ID]; ok {
+		delete(c.sent, bus.ID)
+		return c.write(wsMessage{Type: vehicleEventRemove, ID: bus.ID, Operator: bus.Operator})
+	}
+	return nil
+}
+
+func (c *wsClient) write(message wsMessage) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(message)
+}
+
+func (c *wsClient) close(code int, text string) {
+	deadline := time.Now().Add(wsWriteWait)
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+}
+
+// 現在の購読内容をクライアントに返す形式に変換する
+func (c *wsClient) subscription() *wsSubscription {
+	subscription := &wsSubscription{
+		Operator: make([]string, 0, len(c.operators)),
+		Filters:  make(map[string][]string, len(c.filter.values)),
+		BBox:     c.bbox,
+	}
+	for operator := range c.operators {
+		subscription.Operator = append(subscription.Operator, operator)
+	}
+	sort.Strings(subscription.Operator)
+	for param, values := range c.filter.values {
+		for value := range values {
+			subscription.Filters[param] = append(subscription.Filters[param], value)
+		}
+		sort.Strings(subscription.Filters[param])
+	}
+	for field := range c.expand {
+		subscription.Expand = append(subscription.Expand, field)
+	}
+	sort.Strings(subscription.Expand)
+	return subscription
+}
+
+func isBusFilterParam(param string) bool {
+	for _, p := range busFilterParams {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}